@@ -0,0 +1,390 @@
+package contracts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeLedger is an in-memory world state with per-key history. Each fakeTx
+// buffers its writes and only applies them when the transaction function
+// returns nil, so reads inside a transaction see the committed state just
+// like on a peer.
+type fakeLedger struct {
+	state      map[string][]byte
+	private    map[string]map[string][]byte
+	parameters map[string][]byte
+	history    map[string][]*queryresult.KeyModification
+	clock      time.Time
+	txCount    int
+
+	// Returned by GetQueryResult; nil means the fake behaves like CouchDB
+	queryErr error
+
+	current   *fakeTx
+	lastEvent *fakeEvent
+}
+
+type fakeEvent struct {
+	Name    string
+	Payload []byte
+}
+
+// fakeTx is one transaction proposal against a fakeLedger
+type fakeTx struct {
+	ledger     *fakeLedger
+	mspID      string
+	attributes map[string]string
+	txID       string
+	timestamp  time.Time
+	function   string
+	transient  map[string][]byte
+
+	writes        map[string][]byte
+	deletes       map[string]bool
+	privateWrites map[string]map[string][]byte
+	parameters    map[string][]byte
+	event         *fakeEvent
+}
+
+// newFakeLedger installs a fresh fake behind the ledger and identity seams
+// for the duration of the test.
+func newFakeLedger(t *testing.T) *fakeLedger {
+	t.Helper()
+
+	fake := &fakeLedger{
+		state:      map[string][]byte{},
+		private:    map[string]map[string][]byte{},
+		parameters: map[string][]byte{},
+		history:    map[string][]*queryresult.KeyModification{},
+		clock:      time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	originalLedger, originalIdentity := ledger, identity
+	ledger = func(contractapi.TransactionContextInterface) ledgerStub {
+		return fake.current
+	}
+	identity = func(contractapi.TransactionContextInterface) callerIdentity {
+		return fake.current
+	}
+	t.Cleanup(func() {
+		ledger, identity = originalLedger, originalIdentity
+	})
+
+	return fake
+}
+
+// tx starts a transaction submitted by mspID, one minute after the last one
+func (l *fakeLedger) tx(mspID string) *fakeTx {
+	l.txCount++
+	l.clock = l.clock.Add(time.Minute)
+
+	return &fakeTx{
+		ledger:        l,
+		mspID:         mspID,
+		attributes:    map[string]string{},
+		txID:          fmt.Sprintf("tx%d", l.txCount),
+		timestamp:     l.clock,
+		transient:     map[string][]byte{},
+		writes:        map[string][]byte{},
+		deletes:       map[string]bool{},
+		privateWrites: map[string]map[string][]byte{},
+		parameters:    map[string][]byte{},
+	}
+}
+
+// run executes fn as the transaction and commits its writes if fn succeeds
+func (tx *fakeTx) run(fn func(ctx contractapi.TransactionContextInterface) error) error {
+	err := tx.endorse(fn)
+	if err != nil {
+		return err
+	}
+
+	tx.commit()
+	return nil
+}
+
+// endorse executes fn without committing, so several transactions can be
+// simulated against the same state before any of them is ordered
+func (tx *fakeTx) endorse(fn func(ctx contractapi.TransactionContextInterface) error) error {
+	tx.ledger.current = tx
+	defer func() { tx.ledger.current = nil }()
+
+	return fn(new(contractapi.TransactionContext))
+}
+
+// invoke runs fn as a transaction submitted by mspID
+func (l *fakeLedger) invoke(mspID string, fn func(ctx contractapi.TransactionContextInterface) error) error {
+	return l.tx(mspID).run(fn)
+}
+
+func (tx *fakeTx) commit() {
+	l := tx.ledger
+	timestamp := timestamppb.New(tx.timestamp)
+
+	keys := make([]string, 0, len(tx.writes)+len(tx.deletes))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	for key := range tx.deletes {
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		modification := &queryresult.KeyModification{TxId: tx.txID, Timestamp: timestamp}
+		if tx.deletes[key] {
+			delete(l.state, key)
+			modification.IsDelete = true
+		} else {
+			l.state[key] = tx.writes[key]
+			modification.Value = tx.writes[key]
+		}
+
+		// Peers return history newest first
+		l.history[key] = append([]*queryresult.KeyModification{modification}, l.history[key]...)
+	}
+
+	for collection, writes := range tx.privateWrites {
+		if l.private[collection] == nil {
+			l.private[collection] = map[string][]byte{}
+		}
+		for key, value := range writes {
+			l.private[collection][key] = value
+		}
+	}
+
+	for key, parameter := range tx.parameters {
+		l.parameters[key] = parameter
+	}
+
+	if tx.event != nil {
+		l.lastEvent = tx.event
+	}
+}
+
+func (tx *fakeTx) GetState(key string) ([]byte, error) {
+	return tx.ledger.state[key], nil
+}
+
+func (tx *fakeTx) PutState(key string, value []byte) error {
+	if key == "" {
+		return errors.New("key must not be an empty string")
+	}
+	if len(value) == 0 {
+		return tx.DelState(key)
+	}
+
+	delete(tx.deletes, key)
+	tx.writes[key] = value
+	return nil
+}
+
+func (tx *fakeTx) DelState(key string) error {
+	delete(tx.writes, key)
+	tx.deletes[key] = true
+	return nil
+}
+
+func (tx *fakeTx) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	var results []*queryresult.KV
+	for _, key := range tx.ledger.sortedKeys() {
+		// Range queries never return composite keys
+		if strings.HasPrefix(key, compositeKeyNamespace) {
+			continue
+		}
+		if key < startKey || (endKey != "" && key >= endKey) {
+			continue
+		}
+		results = append(results, &queryresult.KV{Key: key, Value: tx.ledger.state[key]})
+	}
+
+	return &fakeStateIterator{results: results}, nil
+}
+
+func (tx *fakeTx) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*queryresult.KV
+	for _, key := range tx.ledger.sortedKeys() {
+		if strings.HasPrefix(key, prefix) {
+			results = append(results, &queryresult.KV{Key: key, Value: tx.ledger.state[key]})
+		}
+	}
+
+	return &fakeStateIterator{results: results}, nil
+}
+
+// GetQueryResult evaluates the equality conditions of a CouchDB selector.
+// Operator conditions such as $gte match every document, which is enough
+// for callers that filter the results again.
+func (tx *fakeTx) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	if tx.ledger.queryErr != nil {
+		return nil, tx.ledger.queryErr
+	}
+
+	var parsed struct {
+		Selector map[string]interface{} `json:"selector"`
+	}
+	err := json.Unmarshal([]byte(query), &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %q: %v", query, err)
+	}
+
+	var results []*queryresult.KV
+	for _, key := range tx.ledger.sortedKeys() {
+		var document map[string]interface{}
+		if json.Unmarshal(tx.ledger.state[key], &document) != nil {
+			continue
+		}
+
+		matches := true
+		for field, condition := range parsed.Selector {
+			if _, isOperator := condition.(map[string]interface{}); isOperator {
+				continue
+			}
+			if document[field] != condition {
+				matches = false
+			}
+		}
+		if matches {
+			results = append(results, &queryresult.KV{Key: key, Value: tx.ledger.state[key]})
+		}
+	}
+
+	return &fakeStateIterator{results: results}, nil
+}
+
+func (tx *fakeTx) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &fakeHistoryIterator{results: tx.ledger.history[key]}, nil
+}
+
+func (tx *fakeTx) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+
+func (tx *fakeTx) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	parts := strings.Split(strings.TrimPrefix(compositeKey, compositeKeyNamespace), "\x00")
+	if len(parts) < 2 {
+		return "", nil, fmt.Errorf("invalid composite key %q", compositeKey)
+	}
+
+	// The key ends with a delimiter, which leaves an empty last part
+	return parts[0], parts[1 : len(parts)-1], nil
+}
+
+func (tx *fakeTx) GetPrivateData(collection string, key string) ([]byte, error) {
+	return tx.ledger.private[collection][key], nil
+}
+
+func (tx *fakeTx) PutPrivateData(collection string, key string, value []byte) error {
+	if tx.privateWrites[collection] == nil {
+		tx.privateWrites[collection] = map[string][]byte{}
+	}
+	tx.privateWrites[collection][key] = value
+	return nil
+}
+
+func (tx *fakeTx) GetStateValidationParameter(key string) ([]byte, error) {
+	return tx.ledger.parameters[key], nil
+}
+
+func (tx *fakeTx) SetStateValidationParameter(key string, ep []byte) error {
+	tx.parameters[key] = ep
+	return nil
+}
+
+func (tx *fakeTx) GetTransient() (map[string][]byte, error) {
+	return tx.transient, nil
+}
+
+func (tx *fakeTx) GetTxID() string {
+	return tx.txID
+}
+
+func (tx *fakeTx) GetFunctionAndParameters() (string, []string) {
+	return tx.function, nil
+}
+
+func (tx *fakeTx) GetTxTimestamp() (*timestamppb.Timestamp, error) {
+	return timestamppb.New(tx.timestamp), nil
+}
+
+func (tx *fakeTx) SetEvent(name string, payload []byte) error {
+	tx.event = &fakeEvent{Name: name, Payload: payload}
+	return nil
+}
+
+func (tx *fakeTx) GetMSPID() (string, error) {
+	return tx.mspID, nil
+}
+
+func (tx *fakeTx) AssertAttributeValue(attrName string, attrValue string) error {
+	if tx.attributes[attrName] != attrValue {
+		return fmt.Errorf("attribute %s does not have value %s", attrName, attrValue)
+	}
+	return nil
+}
+
+func (l *fakeLedger) sortedKeys() []string {
+	keys := make([]string, 0, len(l.state))
+	for key := range l.state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+type fakeStateIterator struct {
+	results []*queryresult.KV
+}
+
+func (it *fakeStateIterator) HasNext() bool {
+	return len(it.results) > 0
+}
+
+func (it *fakeStateIterator) Next() (*queryresult.KV, error) {
+	if len(it.results) == 0 {
+		return nil, errors.New("no more results")
+	}
+	next := it.results[0]
+	it.results = it.results[1:]
+	return next, nil
+}
+
+func (it *fakeStateIterator) Close() error {
+	return nil
+}
+
+type fakeHistoryIterator struct {
+	results []*queryresult.KeyModification
+}
+
+func (it *fakeHistoryIterator) HasNext() bool {
+	return len(it.results) > 0
+}
+
+func (it *fakeHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	if len(it.results) == 0 {
+		return nil, errors.New("no more results")
+	}
+	next := it.results[0]
+	it.results = it.results[1:]
+	return next, nil
+}
+
+func (it *fakeHistoryIterator) Close() error {
+	return nil
+}
@@ -3,73 +3,5147 @@ package contracts
 
 
 import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"reflect"
 	"sort"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
-	"github.com/hyperledger/fabric/common/util"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// Errors clients can match with errors.Is to tell missing and duplicate
+// medicines, and peers without rich query support, apart from other failures
+var (
+	ErrMedicineNotFound     = errors.New("medicine not found")
+	ErrMedicineExists       = errors.New("medicine already exists")
+	ErrRichQueryUnsupported = errors.New("rich queries are not supported by the state database")
+)
+
+// Version of this contract and of the medicine record layout it writes.
+// Bump schemaVersion whenever stored records change shape, and bump
+// contractVersion with it: the minor version for added fields, the major
+// version when existing records or keys change, as when records were
+// re-keyed by ID.
+const (
+	contractVersion = "2.0.0"
+	schemaVersion   = 10
+)
+
+// Organization allowed to act on any medicine regardless of ownership
+const regulatorMSP = "RegulatorMSP"
+
+// Organization running quality inspections, which may quarantine stock
+// alongside the regulator
+const qualityAssuranceMSP = "QualityAssuranceMSP"
+
+// Composite key object types for auxiliary records
+const (
+	requestObjectType       = "request"
+	metricsObjectType       = "__metrics__"
+	quantityDeltaObjectType = "quantityDelta"
+	ownerIndexObjectType    = "owner~name"
+	nameIndexObjectType     = "name~id"
+	nameHistoryObjectType   = "history~name~id"
+	serialObjectType        = "serial"
+	configObjectType        = "__config__"
+	auditObjectType         = "audit"
+	idempotencyObjectType   = "idempotency"
+)
+
+// Organizations allowed to request medicines until a regulator stores an
+// allow-list with SetAllowedRequesters
+const allowedRequestersConfigKey = "allowedRequesters"
+
+var defaultAllowedRequesters = []string{"ProducerMSP", "SupplierMSP"}
+
+// SHA-256 fingerprints of the certificates allowed to sign manufacturing
+// attestations, stored by a regulator with SetTrustedAttestationCerts. Until
+// a list is stored no attestation is accepted.
+const trustedAttestationCertsConfigKey = "trustedAttestationCerts"
+
+// Private data collection holding confidential request details, and the
+// transient field clients pass them in
+const (
+	requestDetailsCollection   = "OrderCollection"
+	requestDetailsTransientKey = "details"
+)
+
+// Transient field carrying the random salt mixed into the public hash of
+// private request details, and the shortest salt accepted
+const (
+	requestSaltTransientKey = "salt"
+	minRequestSaltLength    = 16
+)
+
+// Transient field in which clients may pass an idempotency key, and how long
+// a used key is remembered
+const idempotencyTransientKey = "idempotencyKey"
+
+var idempotencyTTL = 24 * time.Hour
+
+// Transient field carrying the PEM certificate that signed a manufacturing
+// attestation
+const attestationCertTransientKey = "certificate"
+
+// Prefix Fabric puts in front of every composite key
+const compositeKeyNamespace = "\x00"
+
+// Longest medicine name, in characters, accepted as a world state key
+const maxMedicineNameLength = 256
+
+// Joins a medicine name and an owner in the names of lots opened by
+// ReturnMedicine, so it is not accepted in names of other medicines
+const returnLotSeparator = "@"
+
+// Size limits, in bytes, of free-form medicine attributes
+const (
+	maxAttributeKeyLength   = 64
+	maxAttributeValueLength = 1024
+)
+
+// Units a medicine quantity may be counted in. Records written before units
+// existed are read as defaultUnit.
+const defaultUnit = "unit"
+
+var allowedUnits = map[string]bool{
+	defaultUnit: true,
+	"tablet":    true,
+	"capsule":   true,
+	"vial":      true,
+	"ampoule":   true,
+	"bottle":    true,
+	"box":       true,
+	"ml":        true,
+	"mg":        true,
+}
+
+// Largest quantity of a controlled substance that may change owner in one
+// transfer. A variable so deployments and tests can adjust it.
+var maxControlledTransfer = 1000
+
+// Medicines expiring within this window are reported as expiring soon
+var expiringSoonWindow = 30 * 24 * time.Hour
+
+// Transfer type recorded on a medicine that last changed owner as a donation.
+// Commercial transfers leave the type empty.
+const transferTypeDonation = "DONATION"
+
+// Upper bounds of the near and mid expiry buckets reported by
+// GetExpiryBuckets. Anything expiring later falls in the far bucket.
+const (
+	expiryBucketNear = 30 * 24 * time.Hour
+	expiryBucketMid  = 90 * 24 * time.Hour
+)
+
+// Stock expiring within this window can still change owner, but the
+// transfer event carries a near-expiry warning. Expired stock cannot move.
+var expiryGracePeriod = 30 * 24 * time.Hour
+
+// How long a medicine request stays open before it is treated as expired
+var requestTTL = 7 * 24 * time.Hour
+
+// The stub methods this package uses. Every ledger access goes through
+// ledger(ctx), so tests can swap in a fake without the chaincode harness.
+type ledgerStub interface {
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	DelState(key string) error
+	GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error)
+	GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error)
+	GetQueryResult(query string) (shim.StateQueryIteratorInterface, error)
+	GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error)
+	CreateCompositeKey(objectType string, attributes []string) (string, error)
+	SplitCompositeKey(compositeKey string) (string, []string, error)
+	GetPrivateData(collection string, key string) ([]byte, error)
+	PutPrivateData(collection string, key string, value []byte) error
+	GetStateValidationParameter(key string) ([]byte, error)
+	SetStateValidationParameter(key string, ep []byte) error
+	GetTransient() (map[string][]byte, error)
+	GetTxID() string
+	GetFunctionAndParameters() (string, []string)
+	GetTxTimestamp() (*timestamppb.Timestamp, error)
+	SetEvent(name string, payload []byte) error
+}
+
+var ledger = func(ctx contractapi.TransactionContextInterface) ledgerStub {
+	return ctx.GetStub()
+}
+
+// The client identity methods this package uses, reached through identity(ctx)
+// for the same reason
+type callerIdentity interface {
+	GetMSPID() (string, error)
+	AssertAttributeValue(attrName string, attrValue string) error
+}
+
+var identity = func(ctx contractapi.TransactionContextInterface) callerIdentity {
+	return ctx.GetClientIdentity()
+}
+
 type PharmaChaincode struct {
 	contractapi.Contract
 }
 
-type Medicine struct {
-	Name           string    `json:"name"`
-	Quantity       int       `json:"quantity"`
-	ManufactureDate time.Time `json:"manufactureDate"`
-	ExpiryDate     time.Time `json:"expiryDate"`
-	Owner          string    `json:"owner"`
+type Medicine struct {
+	ID                         string            `json:"id,omitempty"`
+	Name                       string            `json:"name"`
+	Quantity                   int               `json:"quantity"`
+	ManufactureDate            time.Time         `json:"manufactureDate"`
+	ExpiryDate                 time.Time         `json:"expiryDate"`
+	Owner                      string            `json:"owner"`
+	Category                   string            `json:"category"`
+	DosageForm                 string            `json:"dosageForm"`
+	ControlledSubstance        bool              `json:"controlledSubstance"`
+	ReceiptAcknowledged        bool              `json:"receiptAcknowledged"`
+	ReceivedAt                 time.Time         `json:"receivedAt"`
+	MinStockLevel              int               `json:"minStockLevel"`
+	Unit                       string            `json:"unit"`
+	PreviousName               string            `json:"previousName,omitempty"`
+	RenamedTo                  string            `json:"renamedTo,omitempty"`
+	PendingOwner               string            `json:"pendingOwner,omitempty"`
+	CreatedAt                  time.Time         `json:"createdAt"`
+	TransferType               string            `json:"transferType,omitempty"`
+	DonationProgram            string            `json:"donationProgram,omitempty"`
+	DonatedAt                  time.Time         `json:"donatedAt"`
+	Quarantined                bool              `json:"quarantined"`
+	QuarantineReason           string            `json:"quarantineReason,omitempty"`
+	Deleted                    bool              `json:"deleted"`
+	Price                      float64           `json:"price,omitempty"`
+	Currency                   string            `json:"currency,omitempty"`
+	Attributes                 map[string]string `json:"attributes,omitempty"`
+	AttestationCertFingerprint string            `json:"attestationCertFingerprint,omitempty"`
+	AttestationPayloadHash     string            `json:"attestationPayloadHash,omitempty"`
+	LastModifiedAt             time.Time         `json:"lastModifiedAt"`
+	SplitFrom                  string            `json:"splitFrom,omitempty"`
+	OwnerContact               string            `json:"ownerContact,omitempty"`
+}
+
+func (m *Medicine) UnmarshalJSON(data []byte) error {
+	// Decode through an alias type to avoid recursing into this method
+	type medicineAlias Medicine
+	var alias medicineAlias
+	err := json.Unmarshal(data, &alias)
+	if err != nil {
+		return err
+	}
+
+	if alias.Unit == "" {
+		alias.Unit = defaultUnit
+	}
+
+	*m = Medicine(alias)
+	return nil
+}
+
+type MedicineHistory struct {
+	TxID      string    `json:"txId"`
+	Value     Medicine  `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+	IsDelete  bool      `json:"isDelete"`
+}
+
+// JSON view of a history entry with the timestamp already formatted as
+// RFC3339, for clients that cannot parse Go's time encoding
+type medicineHistoryView struct {
+	TxID      string   `json:"txId"`
+	Value     Medicine `json:"value"`
+	Timestamp string   `json:"timestamp"`
+	IsDelete  bool     `json:"isDelete"`
+}
+
+type InventorySummary struct {
+	TotalMedicines       int            `json:"totalMedicines"`
+	Expired              int            `json:"expired"`
+	ActiveQuantityByUnit map[string]int `json:"activeQuantityByUnit"`
+}
+
+// One state change to a medicine, keyed by medicine name and transaction ID
+type AuditEntry struct {
+	TxID         string    `json:"txId"`
+	Action       string    `json:"action"`
+	MedicineName string    `json:"medicineName"`
+	Actor        string    `json:"actor"`
+	Timestamp    time.Time `json:"timestamp"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+type ContractInfo struct {
+	Version       string   `json:"version"`
+	SchemaVersion int      `json:"schemaVersion"`
+	Transactions  []string `json:"transactions"`
+}
+
+type ExpiryBucket struct {
+	Count          int            `json:"count"`
+	QuantityByUnit map[string]int `json:"quantityByUnit"`
+}
+
+type ExpiryBuckets struct {
+	Expired      ExpiryBucket `json:"expired"`
+	Within30Days ExpiryBucket `json:"within30Days"`
+	Within90Days ExpiryBucket `json:"within90Days"`
+	Beyond90Days ExpiryBucket `json:"beyond90Days"`
+}
+
+type LedgerSnapshot struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Count     int         `json:"count"`
+	Medicines []*Medicine `json:"medicines"`
+}
+
+type MedicineDetail struct {
+	Medicine *Medicine          `json:"medicine"`
+	History  []*MedicineHistory `json:"history,omitempty"`
+	Requests []*MedicineRequest `json:"requests,omitempty"`
+}
+
+type HistoryViolation struct {
+	TxID      string    `json:"txId"`
+	Timestamp time.Time `json:"timestamp"`
+	Reason    string    `json:"reason"`
+}
+
+type HistoryReport struct {
+	Name       string             `json:"name"`
+	Versions   int                `json:"versions"`
+	Violations []HistoryViolation `json:"violations"`
+}
+
+type OwnershipChange struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	TxID      string    `json:"txId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// One record in a medicine's lineage. Relation says how it came from its
+// parent node: split off it, or renamed from it.
+type ProvenanceNode struct {
+	Name     string            `json:"name"`
+	Owner    string            `json:"owner"`
+	Quantity int               `json:"quantity"`
+	Relation string            `json:"relation,omitempty"`
+	Renamed  bool              `json:"renamed"`
+	Deleted  bool              `json:"deleted"`
+	Children []*ProvenanceNode `json:"children,omitempty"`
+}
+
+type expiryExtension struct {
+	Name           string    `json:"name"`
+	PreviousExpiry time.Time `json:"previousExpiry"`
+	NewExpiry      time.Time `json:"newExpiry"`
+	ExtendedBy     string    `json:"extendedBy"`
+}
+
+// Payload of LowStock events, emitted when stock falls to its minimum level.
+// The owner contact lets listeners route the alert without a lookup.
+type lowStockEvent struct {
+	Name          string `json:"name"`
+	Owner         string `json:"owner"`
+	OwnerContact  string `json:"ownerContact,omitempty"`
+	Quantity      int    `json:"quantity"`
+	MinStockLevel int    `json:"minStockLevel"`
+}
+
+type bulkTransfer struct {
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Names      []string `json:"names"`
+	NearExpiry []string `json:"nearExpiry,omitempty"`
+}
+
+// Payload of single-medicine transfer events: the medicine's fields plus
+// the near-expiry flag
+type transferEvent struct {
+	*Medicine
+	NearExpiryWarning bool `json:"nearExpiryWarning"`
+}
+
+// A request is addressed by its ID, the transaction ID that created it,
+// together with the requester and medicine name that make up its key.
+type MedicineRequest struct {
+	ID           string    `json:"id"`
+	MedicineName string    `json:"medicineName"`
+	Requester    string    `json:"requester"`
+	Details      string    `json:"details"`
+	DetailsHash  string    `json:"detailsHash"`
+	Quantity     int       `json:"quantity"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// Serial numbers track individual units of a controlled substance lot
+const (
+	serialStatusActive    = "active"
+	serialStatusDispensed = "dispensed"
+	serialStatusDestroyed = "destroyed"
+)
+
+var allowedSerialStatuses = map[string]bool{
+	serialStatusActive:    true,
+	serialStatusDispensed: true,
+	serialStatusDestroyed: true,
+}
+
+type SerializedUnit struct {
+	Serial       string `json:"serial"`
+	MedicineName string `json:"medicineName"`
+	Status       string `json:"status"`
+}
+
+// Outcome of a dry-run validation. Reason names the first rule that failed.
+type ValidationResult struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Part of an AllocateFIFO plan: how much to take from the lot stored under
+// MedicineKey
+type Allocation struct {
+	MedicineKey string `json:"medicineKey"`
+	Quantity    int    `json:"quantity"`
+}
+
+// The document a manufacturing attestation signs: the AddMedicine
+// arguments exactly as submitted, marshalled in this field order
+type attestationPayload struct {
+	Name            string `json:"name"`
+	Quantity        int    `json:"quantity"`
+	ManufactureDate string `json:"manufactureDate"`
+	ExpiryDate      string `json:"expiryDate"`
+}
+
+// Marks an idempotency key as used by a transaction, keyed by caller and key
+type idempotencyRecord struct {
+	Caller    string    `json:"caller"`
+	Key       string    `json:"key"`
+	Method    string    `json:"method"`
+	TxID      string    `json:"txId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Criteria for SearchMedicines; empty fields are ignored
+type medicineFilter struct {
+	Owner                 string `json:"owner"`
+	Category              string `json:"category"`
+	ExpiringBeforeRFC3339 string `json:"expiringBeforeRFC3339"`
+	MinQuantity           int    `json:"minQuantity"`
+}
+
+type medicineInput struct {
+	Name                string  `json:"name"`
+	Quantity            int     `json:"quantity"`
+	ManufactureDate     string  `json:"manufactureDate"`
+	ExpiryDate          string  `json:"expiryDate"`
+	Category            string  `json:"category"`
+	DosageForm          string  `json:"dosageForm"`
+	ControlledSubstance bool    `json:"controlledSubstance"`
+	Unit                string  `json:"unit"`
+	MinStockLevel       int     `json:"minStockLevel"`
+	Price               float64 `json:"price"`
+	Currency            string  `json:"currency"`
+}
+
+func (c *PharmaChaincode) AddMedicine(ctx contractapi.TransactionContextInterface, name string, quantity int, manufactureDate string, expiryDate string, category string, dosageForm string, controlledSubstance bool, unit string, minStockLevel int) (*Medicine, error) {
+	if err := recordInvocation(ctx, "AddMedicine"); err != nil {
+		return nil, err
+	}
+
+	// Get the submitting organization
+	owner, err := requireCallerOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	input := medicineInput{
+		Name:                name,
+		Quantity:            quantity,
+		ManufactureDate:     manufactureDate,
+		ExpiryDate:          expiryDate,
+		Category:            category,
+		DosageForm:          dosageForm,
+		ControlledSubstance: controlledSubstance,
+		Unit:                unit,
+		MinStockLevel:       minStockLevel,
+	}
+
+	medicine, err := newMedicine(ctx, input, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return nil, err
+	}
+
+	return medicine, nil
+}
+
+// AddMedicineFromJSON creates a medicine from a JSON document shaped like the
+// Medicine record. Owner, creation time and transfer state are set by the
+// chaincode; any values the client sends for them are ignored.
+func (c *PharmaChaincode) AddMedicineFromJSON(ctx contractapi.TransactionContextInterface, medicineJSON string) error {
+	if err := recordInvocation(ctx, "AddMedicineFromJSON"); err != nil {
+		return err
+	}
+
+	var medicine Medicine
+	err := json.Unmarshal([]byte(medicineJSON), &medicine)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal medicine JSON: %v", err)
+	}
+
+	// Get the submitting organization
+	owner, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Server-side fields
+	reassignOwner(&medicine, owner)
+	medicine.PreviousName = ""
+	medicine.RenamedTo = ""
+	medicine.Quarantined = false
+	medicine.QuarantineReason = ""
+	medicine.Deleted = false
+	medicine.AttestationCertFingerprint = ""
+	medicine.AttestationPayloadHash = ""
+	medicine.SplitFrom = ""
+
+	err = prepareNewMedicine(ctx, &medicine)
+	if err != nil {
+		return err
+	}
+
+	return putMedicine(ctx, &medicine)
+}
+
+// ValidateMedicineInput runs the checks AddMedicine would without writing
+// anything. Failed rules are reported in the result rather than as an error,
+// which is kept for ledger access failures.
+func (c *PharmaChaincode) ValidateMedicineInput(ctx contractapi.TransactionContextInterface, name string, quantity int, manufactureDate string, expiryDate string) (*ValidationResult, error) {
+	invalid := func(err error) (*ValidationResult, error) {
+		return &ValidationResult{Valid: false, Reason: err.Error()}, nil
+	}
+
+	err := validateNewMedicineName(name)
+	if err != nil {
+		return invalid(err)
+	}
+
+	// Parse dates
+	manufactureTime, err := parseDate("manufacture date", manufactureDate)
+	if err != nil {
+		return invalid(err)
+	}
+
+	expiryTime, err := parseDate("expiry date", expiryDate)
+	if err != nil {
+		return invalid(err)
+	}
+
+	medicine := &Medicine{
+		Name:            name,
+		Quantity:        quantity,
+		ManufactureDate: manufactureTime,
+		ExpiryDate:      expiryTime,
+		Unit:            defaultUnit,
+	}
+	err = validateMedicine(medicine)
+	if err != nil {
+		return invalid(err)
+	}
+
+	// Check if medicine with the same name already exists
+	existingMedicine, err := getMedicineState(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingMedicine != nil {
+		return invalid(fmt.Errorf("%w: %s", ErrMedicineExists, name))
+	}
+
+	return &ValidationResult{Valid: true}, nil
+}
+
+// AddMedicineWithAttestation adds a medicine only if attestationB64, a
+// base64 ASN.1 ECDSA signature over the SHA-256 of the attestationPayload
+// JSON, verifies against the certificate in the transient field, and that
+// certificate is on the regulator's trust list and valid at the transaction
+// time. The record keeps the certificate fingerprint and the payload hash
+// rather than the signature, since an ECDSA signature is malleable and one
+// payload can carry many valid signatures.
+func (c *PharmaChaincode) AddMedicineWithAttestation(ctx contractapi.TransactionContextInterface, name string, quantity int, manufactureDate string, expiryDate string, attestationB64 string) (*Medicine, error) {
+	if err := recordInvocation(ctx, "AddMedicineWithAttestation"); err != nil {
+		return nil, err
+	}
+
+	owner, err := requireCallerOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	transient, err := ledger(ctx).GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient data: %v", err)
+	}
+	certPEM, ok := transient[attestationCertTransientKey]
+	if !ok || len(certPEM) == 0 {
+		return nil, fmt.Errorf("signing certificate must be passed in the transient field '%s'", attestationCertTransientKey)
+	}
+
+	cert, err := parseAttestationCert(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted, err := trustedAttestationCerts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := certFingerprint(cert)
+	if !trusted[fingerprint] {
+		return nil, fmt.Errorf("signing certificate %s is not trusted for attestations", fingerprint)
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("signing certificate %s is not valid at %s", fingerprint, now.Format(time.RFC3339))
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attestationB64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode attestation: %v", err)
+	}
+
+	payloadJSON, err := json.Marshal(attestationPayload{
+		Name:            name,
+		Quantity:        quantity,
+		ManufactureDate: manufactureDate,
+		ExpiryDate:      expiryDate,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal attestation payload: %v", err)
+	}
+
+	err = verifyAttestation(cert, payloadJSON, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	input := medicineInput{
+		Name:            name,
+		Quantity:        quantity,
+		ManufactureDate: manufactureDate,
+		ExpiryDate:      expiryDate,
+	}
+
+	medicine, err := newMedicine(ctx, input, owner)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := sha256.Sum256(payloadJSON)
+	medicine.AttestationCertFingerprint = fingerprint
+	medicine.AttestationPayloadHash = hex.EncodeToString(payloadHash[:])
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return nil, err
+	}
+
+	return medicine, nil
+}
+
+func (c *PharmaChaincode) AddMedicines(ctx contractapi.TransactionContextInterface, medicinesJSON string) error {
+	if err := recordInvocation(ctx, "AddMedicines"); err != nil {
+		return err
+	}
+
+	var inputs []medicineInput
+	err := json.Unmarshal([]byte(medicinesJSON), &inputs)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal medicines JSON: %v", err)
+	}
+
+	// Get the submitting organization
+	owner, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Validate every entry before writing anything so the batch is all-or-nothing.
+	// GetState does not see writes made earlier in the same transaction, so
+	// duplicates within the batch have to be caught here.
+	seen := make(map[string]bool)
+	var medicines []*Medicine
+	for i, input := range inputs {
+		if seen[input.Name] {
+			return fmt.Errorf("medicine with name %s appears more than once in batch", input.Name)
+		}
+		seen[input.Name] = true
+
+		medicine, err := newMedicine(ctx, input, owner)
+		if err != nil {
+			return fmt.Errorf("invalid medicine at index %d: %v", i, err)
+		}
+		medicines = append(medicines, medicine)
+	}
+
+	for _, medicine := range medicines {
+		err = putMedicine(ctx, medicine)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpsertMedicine is the retry-safe counterpart of AddMedicine: it creates the
+// medicine when absent and otherwise updates its quantity and dates, leaving
+// the owner and other fields untouched. AddMedicine stays create-only. The
+// quantity given on update replaces the effective quantity, so pending
+// AdjustQuantity deltas are discarded, and like ExtendExpiry an update may
+// not bring the expiry date forward.
+func (c *PharmaChaincode) UpsertMedicine(ctx contractapi.TransactionContextInterface, name string, quantity int, manufactureDate string, expiryDate string) error {
+	if err := recordInvocation(ctx, "UpsertMedicine"); err != nil {
+		return err
+	}
+
+	// Get the submitting organization
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+
+	existingMedicine, err := getMedicineState(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+
+	// Create the medicine if it does not exist yet
+	if existingMedicine == nil {
+		input := medicineInput{
+			Name:            name,
+			Quantity:        quantity,
+			ManufactureDate: manufactureDate,
+			ExpiryDate:      expiryDate,
+		}
+
+		medicine, err := newMedicine(ctx, input, caller)
+		if err != nil {
+			return err
+		}
+
+		return putMedicine(ctx, medicine)
+	}
+
+	var medicine Medicine
+	err = json.Unmarshal(existingMedicine, &medicine)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal medicine JSON: %v", err)
+	}
+
+	// Archived records and rename tombstones still hold the name but are not
+	// live medicines, so they can be neither updated nor recreated here
+	if medicine.Deleted {
+		return fmt.Errorf("medicine %s is archived and must be restored before it can be updated", name)
+	}
+	if medicine.RenamedTo != "" {
+		return fmt.Errorf("medicine %s was renamed to %s and cannot be updated", name, medicine.RenamedTo)
+	}
+
+	// Only the owning organization may update an existing medicine
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may update medicine %s", medicine.Owner, name)
+	}
+
+	err = checkNoPendingTransfer(&medicine)
+	if err != nil {
+		return err
+	}
+
+	// Parse dates
+	manufactureTime, err := parseDate("manufacture date", manufactureDate)
+	if err != nil {
+		return err
+	}
+
+	expiryTime, err := parseDate("expiry date", expiryDate)
+	if err != nil {
+		return err
+	}
+
+	if expiryTime.Before(medicine.ExpiryDate) {
+		return fmt.Errorf("new expiry %s must not be earlier than current expiry %s", expiryDate, medicine.ExpiryDate.Format(time.RFC3339))
+	}
+
+	medicine.Quantity = quantity
+	medicine.ManufactureDate = manufactureTime
+	medicine.ExpiryDate = expiryTime
+
+	err = validateMedicine(&medicine)
+	if err != nil {
+		return err
+	}
+
+	// The new quantity already accounts for any pending adjustments
+	err = deleteQuantityDeltas(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Reads do not see this transaction's deletes, so check the serials
+	// against the new quantity alone
+	err = checkSerialLimit(ctx, &medicine, 0, medicine.Quantity)
+	if err != nil {
+		return err
+	}
+
+	return putMedicine(ctx, &medicine)
+}
+
+func (c *PharmaChaincode) SplitMedicine(ctx contractapi.TransactionContextInterface, name string, splitQuantity int, newName string, newOwner string) error {
+	// A retried submission with a known idempotency key is a no-op and is
+	// not counted again
+	seen, err := claimIdempotencyKey(ctx, "SplitMedicine")
+	if err != nil || seen {
+		return err
+	}
+
+	if err := recordInvocation(ctx, "SplitMedicine"); err != nil {
+		return err
+	}
+
+	// Check if the source medicine exists
+	source, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may split the medicine
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != source.Owner {
+		return fmt.Errorf("only the owner %s may split medicine %s", source.Owner, name)
+	}
+
+	err = checkNoPendingTransfer(source)
+	if err != nil {
+		return err
+	}
+
+	err = checkNotQuarantined(source)
+	if err != nil {
+		return err
+	}
+
+	available, err := availableQuantity(ctx, source)
+	if err != nil {
+		return err
+	}
+	if splitQuantity <= 0 || splitQuantity > available {
+		return fmt.Errorf("split quantity %d must be between 1 and %d", splitQuantity, available)
+	}
+
+	if newOwner == "" {
+		return fmt.Errorf("new owner must not be empty")
+	}
+
+	// Splitting off to another organization is a transfer of that quantity
+	if newOwner != source.Owner {
+		err = checkControlledTransfer(source, splitQuantity)
+		if err != nil {
+			return err
+		}
+
+		_, err = checkTransferExpiry(ctx, source)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = validateNewMedicineName(newName)
+	if err != nil {
+		return err
+	}
+
+	// Check if the new medicine name is free
+	existingMedicine, err := getMedicineState(ctx, newName)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingMedicine != nil {
+		return fmt.Errorf("%w: %s", ErrMedicineExists, newName)
+	}
+
+	// The split keeps the product details of the source lot
+	split := *source
+	split.Name = newName
+	split.Quantity = splitQuantity
+	split.SplitFrom = source.Name
+	split.ID = medicineID(ctx, newName)
+	reassignOwner(&split, newOwner)
+	split.CreatedAt, err = txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The remaining quantity already accounts for any pending adjustments
+	err = deleteQuantityDeltas(ctx, source.Name)
+	if err != nil {
+		return err
+	}
+	source.Quantity = available - splitQuantity
+
+	// Reads do not see this transaction's deletes, so check the serials
+	// against the new quantity alone
+	err = checkSerialLimit(ctx, source, 0, source.Quantity)
+	if err != nil {
+		return err
+	}
+
+	err = putMedicine(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	err = putMedicine(ctx, &split)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "MedicineSplit", []*Medicine{source, &split})
+}
+
+// ReturnMedicine sends part of the caller's stock back to toOwner. The stock
+// goes back into the lot it was split from when toOwner still holds it, and
+// otherwise into a lot under returnLotName that the first such return opens.
+func (c *PharmaChaincode) ReturnMedicine(ctx contractapi.TransactionContextInterface, name string, quantity int, toOwner string, reason string) error {
+	// A retried submission with a known idempotency key is a no-op and is
+	// not counted again
+	seen, err := claimIdempotencyKey(ctx, "ReturnMedicine")
+	if err != nil || seen {
+		return err
+	}
+
+	if err := recordInvocation(ctx, "ReturnMedicine"); err != nil {
+		return err
+	}
+
+	// Check if the returned medicine exists
+	source, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may return the medicine
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != source.Owner {
+		return fmt.Errorf("only the owner %s may return medicine %s", source.Owner, name)
+	}
+
+	if toOwner == "" || toOwner == caller {
+		return fmt.Errorf("medicine must be returned to another organization")
+	}
+	if reason == "" {
+		return fmt.Errorf("return reason must not be empty")
+	}
+	available, err := availableQuantity(ctx, source)
+	if err != nil {
+		return err
+	}
+	if quantity <= 0 || quantity > available {
+		return fmt.Errorf("return quantity %d must be between 1 and %d", quantity, available)
+	}
+
+	err = checkNoPendingTransfer(source)
+	if err != nil {
+		return err
+	}
+
+	err = checkNotQuarantined(source)
+	if err != nil {
+		return err
+	}
+
+	_, err = checkTransferExpiry(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	err = checkControlledTransfer(source, quantity)
+	if err != nil {
+		return err
+	}
+
+	// Add to toOwner's holding, or open one with the product details of the
+	// returned record
+	target, err := returnTarget(ctx, source, toOwner)
+	if err != nil {
+		return err
+	}
+	if target != nil {
+		if target.Deleted {
+			return fmt.Errorf("medicine %s is archived and cannot receive returns", target.Name)
+		}
+		target.Quantity += quantity
+	} else {
+		targetName := returnLotName(name, toOwner)
+		if utf8.RuneCountInString(targetName) > maxMedicineNameLength {
+			return fmt.Errorf("medicine name must be at most %d characters", maxMedicineNameLength)
+		}
+
+		// A rename tombstone also reads as not found but must not be reused
+		existingMedicine, err := getMedicineState(ctx, targetName)
+		if err != nil {
+			return fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if existingMedicine != nil {
+			return fmt.Errorf("%w: %s", ErrMedicineExists, targetName)
+		}
+
+		returned := *source
+		returned.Name = targetName
+		returned.Quantity = quantity
+		returned.SplitFrom = source.Name
+		returned.ID = medicineID(ctx, targetName)
+		reassignOwner(&returned, toOwner)
+		returned.CreatedAt, err = txTimestamp(ctx)
+		if err != nil {
+			return err
+		}
+		target = &returned
+	}
+
+	// The remaining quantity already accounts for any pending adjustments
+	err = deleteQuantityDeltas(ctx, source.Name)
+	if err != nil {
+		return err
+	}
+	source.Quantity = available - quantity
+
+	// Reads do not see this transaction's deletes, so check the serials
+	// against the new quantity alone
+	err = checkSerialLimit(ctx, source, 0, source.Quantity)
+	if err != nil {
+		return err
+	}
+
+	err = putMedicine(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	err = putMedicine(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	// Replace the audit entries putMedicine wrote with ones carrying the reason
+	for _, medicine := range []*Medicine{source, target} {
+		err = writeAuditEntry(ctx, medicine.Name, reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	return emitEvent(ctx, "MedicineReturned", []*Medicine{source, target})
+}
+
+func (c *PharmaChaincode) AcknowledgeReceipt(ctx contractapi.TransactionContextInterface, name string) error {
+	if err := recordInvocation(ctx, "AcknowledgeReceipt"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the receiving (current) owner may acknowledge custody
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may acknowledge receipt of medicine %s", medicine.Owner, name)
+	}
+
+	if medicine.ReceiptAcknowledged {
+		return fmt.Errorf("receipt of medicine %s was already acknowledged at %s", name, medicine.ReceivedAt.Format(time.RFC3339))
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	medicine.ReceiptAcknowledged = true
+	medicine.ReceivedAt = now
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "ReceiptAcknowledged", medicine)
+}
+
+func (c *PharmaChaincode) ExtendExpiry(ctx contractapi.TransactionContextInterface, name string, newExpiryRFC3339 string) error {
+	if err := recordInvocation(ctx, "ExtendExpiry"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization or a regulator may relabel the expiry
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner && caller != regulatorMSP {
+		return fmt.Errorf("only the owner %s may extend the expiry of medicine %s", medicine.Owner, name)
+	}
+
+	newExpiry, err := parseDate("expiry date", newExpiryRFC3339)
+	if err != nil {
+		return err
+	}
+
+	// This method can only push the expiry later
+	if !newExpiry.After(medicine.ExpiryDate) {
+		return fmt.Errorf("new expiry %s must be later than current expiry %s", newExpiryRFC3339, medicine.ExpiryDate.Format(time.RFC3339))
+	}
+
+	extension := expiryExtension{
+		Name:           name,
+		PreviousExpiry: medicine.ExpiryDate,
+		NewExpiry:      newExpiry,
+		ExtendedBy:     caller,
+	}
+
+	medicine.ExpiryDate = newExpiry
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "ExpiryExtended", extension)
+}
+
+func (c *PharmaChaincode) SetMinStockLevel(ctx contractapi.TransactionContextInterface, name string, minStockLevel int) error {
+	if err := recordInvocation(ctx, "SetMinStockLevel"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may set its reorder level
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may set the minimum stock level of medicine %s", medicine.Owner, name)
+	}
+
+	if minStockLevel < 0 {
+		return fmt.Errorf("minimum stock level must not be negative, got %d", minStockLevel)
+	}
+
+	medicine.MinStockLevel = minStockLevel
+
+	return putMedicine(ctx, medicine)
+}
+
+// SetOwnerContact stores the owner's notification handle on the medicine so
+// event listeners can route alerts without a separate lookup.
+func (c *PharmaChaincode) SetOwnerContact(ctx contractapi.TransactionContextInterface, name string, contact string) error {
+	if err := recordInvocation(ctx, "SetOwnerContact"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may set its contact
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may set the contact of medicine %s", medicine.Owner, name)
+	}
+
+	if contact == "" {
+		return fmt.Errorf("owner contact must not be empty")
+	}
+
+	medicine.OwnerContact = contact
+
+	return putMedicine(ctx, medicine)
+}
+
+func (c *PharmaChaincode) SetMedicineAttribute(ctx contractapi.TransactionContextInterface, name string, key string, value string) error {
+	if err := recordInvocation(ctx, "SetMedicineAttribute"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may describe its medicine
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may set attributes of medicine %s", medicine.Owner, name)
+	}
+
+	err = validateAttribute(key, value)
+	if err != nil {
+		return err
+	}
+
+	if medicine.Attributes == nil {
+		medicine.Attributes = make(map[string]string)
+	}
+	medicine.Attributes[key] = value
+
+	return putMedicine(ctx, medicine)
+}
+
+func (c *PharmaChaincode) GetMedicineAttribute(ctx contractapi.TransactionContextInterface, name string, key string) (string, error) {
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := medicine.Attributes[key]
+	if !ok {
+		return "", fmt.Errorf("medicine %s has no attribute %s", name, key)
+	}
+
+	return value, nil
+}
+
+func (c *PharmaChaincode) SetMedicineEndorsement(ctx contractapi.TransactionContextInterface, name string, orgs []string) error {
+	if err := recordInvocation(ctx, "SetMedicineEndorsement"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization or a regulator may lock the record
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner && caller != regulatorMSP {
+		return fmt.Errorf("only the owner %s may set the endorsement policy of medicine %s", medicine.Owner, name)
+	}
+
+	if len(orgs) == 0 {
+		return fmt.Errorf("endorsement policy for medicine %s needs at least one organization", name)
+	}
+
+	// Require a peer of every listed organization to endorse changes to this key
+	endorsementPolicy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create endorsement policy: %v", err)
+	}
+	err = endorsementPolicy.AddOrgs(statebased.RoleTypePeer, orgs...)
+	if err != nil {
+		return fmt.Errorf("failed to add organizations to endorsement policy: %v", err)
+	}
+
+	policy, err := endorsementPolicy.Policy()
+	if err != nil {
+		return fmt.Errorf("failed to build endorsement policy: %v", err)
+	}
+
+	err = ledger(ctx).SetStateValidationParameter(medicineKey(medicine), policy)
+	if err != nil {
+		return fmt.Errorf("failed to set endorsement policy: %v", err)
+	}
+
+	return writeAudit(ctx, name)
+}
+
+func (c *PharmaChaincode) GetMedicineEndorsement(ctx contractapi.TransactionContextInterface, name string) ([]string, error) {
+	key, err := resolveMedicineKey(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := ledger(ctx).GetStateValidationParameter(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get endorsement policy: %v", err)
+	}
+
+	// Keys without their own policy fall back to the chaincode policy
+	if policy == nil {
+		return []string{}, nil
+	}
+
+	endorsementPolicy, err := statebased.NewStateEP(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse endorsement policy: %v", err)
+	}
+
+	orgs := endorsementPolicy.ListOrgs()
+	sort.Strings(orgs)
+
+	return orgs, nil
+}
+
+// AdjustQuantity records a quantity change as its own delta key instead of
+// rewriting the medicine record. Concurrent adjustments write distinct keys
+// and read nothing they both write, so they no longer invalidate each other
+// under MVCC. The price is weaker consistency: the deltas are not read here,
+// so two concurrent decrements are never checked against each other and the
+// effective quantity can drop below zero. Use GetEffectiveQuantity to read
+// the base quantity plus all deltas; the Quantity field on the record alone
+// does not include them, so stock checks and reports go through
+// availableQuantity. A decrement of a medicine with a minimum stock level
+// does read the deltas, to emit a LowStock event when it takes the stock
+// from above that level to at or below it, and so can conflict with
+// concurrent adjustments of the same medicine.
+func (c *PharmaChaincode) AdjustQuantity(ctx contractapi.TransactionContextInterface, name string, delta int) error {
+	// A retried submission with a known idempotency key is a no-op and is
+	// not counted again
+	seen, err := claimIdempotencyKey(ctx, "AdjustQuantity")
+	if err != nil || seen {
+		return err
+	}
+
+	if err := recordInvocation(ctx, "AdjustQuantity"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may adjust its stock
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may adjust the quantity of medicine %s", medicine.Owner, name)
+	}
+
+	err = checkNoPendingTransfer(medicine)
+	if err != nil {
+		return err
+	}
+
+	if delta == 0 {
+		return fmt.Errorf("quantity delta must not be zero")
+	}
+
+	// The transaction ID keeps every delta key unique
+	key, err := ledger(ctx).CreateCompositeKey(quantityDeltaObjectType, []string{name, ledger(ctx).GetTxID()})
+	if err != nil {
+		return fmt.Errorf("failed to create quantity delta key: %v", err)
+	}
+
+	deltaJSON, err := json.Marshal(delta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal quantity delta: %v", err)
+	}
+
+	err = ledger(ctx).PutState(key, deltaJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	err = writeAudit(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Reads do not see this transaction's delta, so add it to the quantity
+	// read before it
+	if delta < 0 && medicine.MinStockLevel > 0 {
+		before, err := availableQuantity(ctx, medicine)
+		if err != nil {
+			return err
+		}
+		after := before + delta
+		if before > medicine.MinStockLevel && after <= medicine.MinStockLevel {
+			return emitEvent(ctx, "LowStock", lowStockEvent{
+				Name:          name,
+				Owner:         medicine.Owner,
+				OwnerContact:  medicine.OwnerContact,
+				Quantity:      after,
+				MinStockLevel: medicine.MinStockLevel,
+			})
+		}
+	}
+
+	return nil
+}
+
+func (c *PharmaChaincode) GetEffectiveQuantity(ctx contractapi.TransactionContextInterface, name string) (int, error) {
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	return availableQuantity(ctx, medicine)
+}
+
+// GetTotalQuantity reports the stock available under a medicine name,
+// including pending quantity adjustments. An unknown name has a total of 0
+// rather than a not-found error.
+func (c *PharmaChaincode) GetTotalQuantity(ctx contractapi.TransactionContextInterface, name string) (int, error) {
+	lots, err := medicineLots(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, lot := range lots {
+		quantity, err := availableQuantity(ctx, lot)
+		if err != nil {
+			return 0, err
+		}
+		total += quantity
+	}
+
+	return total, nil
+}
+
+// AllocateFIFO plans how to take quantity units of a medicine from its lots,
+// earliest expiry first, without changing any state. Expired and quarantined
+// lots are not drawn from.
+func (c *PharmaChaincode) AllocateFIFO(ctx contractapi.TransactionContextInterface, name string, quantity int) ([]Allocation, error) {
+	if quantity <= 0 {
+		return nil, fmt.Errorf("quantity to allocate must be positive, got %d", quantity)
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lots, err := medicineLots(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort the lots by expiry date in ascending order
+	sort.Slice(lots, func(i, j int) bool {
+		if !lots[i].ExpiryDate.Equal(lots[j].ExpiryDate) {
+			return lots[i].ExpiryDate.Before(lots[j].ExpiryDate)
+		}
+		return medicineLess(lots[i], lots[j])
+	})
+
+	allocations := []Allocation{}
+	remaining := quantity
+	for _, lot := range lots {
+		if remaining == 0 {
+			break
+		}
+		if lot.ExpiryDate.Before(now) || lot.Quarantined {
+			continue
+		}
+
+		available, err := availableQuantity(ctx, lot)
+		if err != nil {
+			return nil, err
+		}
+		if available <= 0 {
+			continue
+		}
+
+		take := available
+		if take > remaining {
+			take = remaining
+		}
+		allocations = append(allocations, Allocation{MedicineKey: lot.Name, Quantity: take})
+		remaining -= take
+	}
+
+	if remaining > 0 {
+		return nil, fmt.Errorf("only %d of the requested %d units of medicine %s are available", quantity-remaining, quantity, name)
+	}
+
+	return allocations, nil
+}
+
+func (c *PharmaChaincode) RestockMedicine(ctx contractapi.TransactionContextInterface, name string, addQuantity int) error {
+	// A retried submission with a known idempotency key is a no-op and is
+	// not counted again
+	seen, err := claimIdempotencyKey(ctx, "RestockMedicine")
+	if err != nil || seen {
+		return err
+	}
+
+	if err := recordInvocation(ctx, "RestockMedicine"); err != nil {
+		return err
+	}
+
+	if addQuantity <= 0 {
+		return fmt.Errorf("restock quantity must be positive, got %d", addQuantity)
+	}
+
+	// Check if medicine exists. Reading the record puts it in the read set,
+	// so a concurrent restock fails MVCC validation instead of being lost.
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may restock the medicine
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may restock medicine %s", medicine.Owner, name)
+	}
+
+	err = checkNoPendingTransfer(medicine)
+	if err != nil {
+		return err
+	}
+
+	medicine.Quantity += addQuantity
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "MedicineRestocked", medicine)
+}
+
+func (c *PharmaChaincode) TransferAllMedicines(ctx contractapi.TransactionContextInterface, newOwner string) error {
+	// A retried submission with a known idempotency key is a no-op and is
+	// not counted again
+	seen, err := claimIdempotencyKey(ctx, "TransferAllMedicines")
+	if err != nil || seen {
+		return err
+	}
+
+	if err := recordInvocation(ctx, "TransferAllMedicines"); err != nil {
+		return err
+	}
+
+	// Medicines move out of the submitting organization's holdings
+	owner, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = transferAllMedicines(ctx, owner, newOwner)
+	return err
+}
+
+// TransferAllFromOwner moves every medicine held by fromOwner to toOwner and
+// returns how many moved. Only fromOwner itself or a regulator may do so.
+func (c *PharmaChaincode) TransferAllFromOwner(ctx contractapi.TransactionContextInterface, fromOwner string, toOwner string) (int, error) {
+	if err := recordInvocation(ctx, "TransferAllFromOwner"); err != nil {
+		return 0, err
+	}
+
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if caller != fromOwner && caller != regulatorMSP {
+		return 0, fmt.Errorf("only %s or a regulator may transfer medicines owned by %s", fromOwner, fromOwner)
+	}
+
+	return transferAllMedicines(ctx, fromOwner, toOwner)
+}
+
+// SetThreshold sets the minimum stock level under the name the low-stock
+// API uses. The threshold and the reorder level are the same field.
+func (c *PharmaChaincode) SetThreshold(ctx contractapi.TransactionContextInterface, name string, threshold int) error {
+	return c.SetMinStockLevel(ctx, name, threshold)
+}
+
+// QuarantineMedicine freezes a medicine that failed inspection. It stays
+// listed but cannot be transferred, split, donated or requested until
+// released.
+func (c *PharmaChaincode) QuarantineMedicine(ctx contractapi.TransactionContextInterface, name string, reason string) error {
+	if err := recordInvocation(ctx, "QuarantineMedicine"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	err = checkQualityAssurance(ctx)
+	if err != nil {
+		return err
+	}
+
+	if medicine.Quarantined {
+		return fmt.Errorf("medicine %s is already quarantined", name)
+	}
+	if reason == "" {
+		return fmt.Errorf("quarantine reason must not be empty")
+	}
+
+	medicine.Quarantined = true
+	medicine.QuarantineReason = reason
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "MedicineQuarantined", medicine)
+}
+
+func (c *PharmaChaincode) ReleaseQuarantine(ctx contractapi.TransactionContextInterface, name string) error {
+	if err := recordInvocation(ctx, "ReleaseQuarantine"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	err = checkQualityAssurance(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !medicine.Quarantined {
+		return fmt.Errorf("medicine %s is not quarantined", name)
+	}
+
+	medicine.Quarantined = false
+	medicine.QuarantineReason = ""
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "QuarantineReleased", medicine)
+}
+
+// DonateMedicine hands a medicine to the recipient straight away, like
+// TransferAllMedicines, and marks the record as a donation under the given
+// program so donations can be reported apart from sales.
+func (c *PharmaChaincode) DonateMedicine(ctx contractapi.TransactionContextInterface, name string, recipient string, program string) error {
+	// A retried submission with a known idempotency key is a no-op and is
+	// not counted again
+	seen, err := claimIdempotencyKey(ctx, "DonateMedicine")
+	if err != nil || seen {
+		return err
+	}
+
+	if err := recordInvocation(ctx, "DonateMedicine"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may donate the medicine
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may donate medicine %s", medicine.Owner, name)
+	}
+
+	err = checkNoPendingTransfer(medicine)
+	if err != nil {
+		return err
+	}
+
+	err = checkNotQuarantined(medicine)
+	if err != nil {
+		return err
+	}
+
+	if recipient == "" || recipient == medicine.Owner {
+		return fmt.Errorf("new owner must be a different organization than %s", medicine.Owner)
+	}
+	if program == "" {
+		return fmt.Errorf("donation program must not be empty")
+	}
+
+	quantity, err := availableQuantity(ctx, medicine)
+	if err != nil {
+		return err
+	}
+	err = checkControlledTransfer(medicine, quantity)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	nearExpiry, err := checkTransferExpiry(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	reassignOwner(medicine, recipient)
+	medicine.TransferType = transferTypeDonation
+	medicine.DonationProgram = program
+	medicine.DonatedAt = now
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "MedicineDonated", transferEvent{Medicine: medicine, NearExpiryWarning: nearExpiry})
+}
+
+func (c *PharmaChaincode) InitiateTransfer(ctx contractapi.TransactionContextInterface, name string, toOrg string) error {
+	// A retried submission with a known idempotency key is a no-op and is
+	// not counted again
+	seen, err := claimIdempotencyKey(ctx, "InitiateTransfer")
+	if err != nil || seen {
+		return err
+	}
+
+	if err := recordInvocation(ctx, "InitiateTransfer"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may offer the medicine to another
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may transfer medicine %s", medicine.Owner, name)
+	}
+
+	err = checkNoPendingTransfer(medicine)
+	if err != nil {
+		return err
+	}
+
+	err = checkNotQuarantined(medicine)
+	if err != nil {
+		return err
+	}
+
+	if toOrg == "" || toOrg == medicine.Owner {
+		return fmt.Errorf("new owner must be a different organization than %s", medicine.Owner)
+	}
+
+	quantity, err := availableQuantity(ctx, medicine)
+	if err != nil {
+		return err
+	}
+	err = checkControlledTransfer(medicine, quantity)
+	if err != nil {
+		return err
+	}
+
+	nearExpiry, err := checkTransferExpiry(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	// The owner stays unchanged until the receiver accepts
+	medicine.PendingOwner = toOrg
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "TransferInitiated", transferEvent{Medicine: medicine, NearExpiryWarning: nearExpiry})
+}
+
+func (c *PharmaChaincode) AcceptTransfer(ctx contractapi.TransactionContextInterface, name string) error {
+	// A retried submission with a known idempotency key is a no-op and is
+	// not counted again
+	seen, err := claimIdempotencyKey(ctx, "AcceptTransfer")
+	if err != nil || seen {
+		return err
+	}
+
+	if err := recordInvocation(ctx, "AcceptTransfer"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if medicine.PendingOwner == "" {
+		return fmt.Errorf("medicine %s has no pending transfer", name)
+	}
+
+	// Only the organization the medicine was offered to may accept it
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.PendingOwner {
+		return fmt.Errorf("only the pending owner %s may accept medicine %s", medicine.PendingOwner, name)
+	}
+
+	err = checkNotQuarantined(medicine)
+	if err != nil {
+		return err
+	}
+
+	// The medicine may have expired while the transfer was pending
+	nearExpiry, err := checkTransferExpiry(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	err = transferOwnership(ctx, medicine, caller)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "TransferAccepted", transferEvent{Medicine: medicine, NearExpiryWarning: nearExpiry})
+}
+
+func (c *PharmaChaincode) CancelTransfer(ctx contractapi.TransactionContextInterface, name string) error {
+	if err := recordInvocation(ctx, "CancelTransfer"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the sending owner may withdraw the offer
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may cancel the transfer of medicine %s", medicine.Owner, name)
+	}
+
+	if medicine.PendingOwner == "" {
+		return fmt.Errorf("medicine %s has no pending transfer", name)
+	}
+
+	medicine.PendingOwner = ""
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	return emitEvent(ctx, "TransferCancelled", medicine)
+}
+
+// RenameMedicine moves a medicine to a new key. The new record points back
+// with PreviousName and the old key keeps a tombstone with RenamedTo, since
+// GetHistoryForKey only ever covers a single key; callers reconstructing
+// the full history have to follow those links.
+func (c *PharmaChaincode) RenameMedicine(ctx contractapi.TransactionContextInterface, oldName string, newName string) error {
+	if err := recordInvocation(ctx, "RenameMedicine"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization or a regulator may rename the medicine
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner && caller != regulatorMSP {
+		return fmt.Errorf("only the owner %s may rename medicine %s", medicine.Owner, oldName)
+	}
+
+	err = checkNoPendingTransfer(medicine)
+	if err != nil {
+		return err
+	}
+
+	err = validateNewMedicineName(newName)
+	if err != nil {
+		return err
+	}
+
+	// Tombstones occupy their key too, so a rename chain never loops
+	existingMedicine, err := getMedicineState(ctx, newName)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingMedicine != nil {
+		return fmt.Errorf("%w: %s", ErrMedicineExists, newName)
+	}
+
+	// Requests are keyed by name and would be orphaned by the rename
+	requests, err := c.GetRequestsForMedicine(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if len(requests) > 0 {
+		return fmt.Errorf("medicine %s still has %d outstanding requests", oldName, len(requests))
+	}
+
+	// Fold quantity deltas into the new record; the old key no longer accepts any
+	deltas, err := sumQuantityDeltas(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	err = deleteQuantityDeltas(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	renamed := *medicine
+	renamed.Name = newName
+	renamed.Quantity += deltas
+	renamed.PreviousName = oldName
+	renamed.RenamedTo = ""
+
+	// The lineage runs through the tombstone, which keeps any split parent
+	renamed.SplitFrom = ""
+
+	// The tombstone drops out of the owner index
+	err = deleteOwnerIndex(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	// The renamed record keeps its ID, so the tombstone needs one of its own
+	if medicine.ID != "" {
+		err = deleteNameIndex(ctx, medicine)
+		if err != nil {
+			return err
+		}
+
+		medicine.ID = medicineID(ctx, oldName)
+		err = putNameIndex(ctx, medicine)
+		if err != nil {
+			return err
+		}
+	}
+
+	medicine.RenamedTo = newName
+	tombstoneJSON, err := json.Marshal(medicine)
+	if err != nil {
+		return fmt.Errorf("failed to marshal medicine to JSON: %v", err)
+	}
+	err = ledger(ctx).PutState(medicineKey(medicine), tombstoneJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	err = writeAudit(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	// Serial keys start with the medicine name, so the units follow the stock
+	err = moveSerials(ctx, oldName, &renamed)
+	if err != nil {
+		return err
+	}
+
+	return putMedicine(ctx, &renamed)
+}
+
+// DeleteMedicine archives a medicine rather than removing it: the record
+// stays on the ledger marked Deleted, drops out of reads and listings, and can
+// be brought back with RestoreMedicine. PurgeMedicine removes it for good.
+// The returned snapshot is the record as it was before archiving.
+func (c *PharmaChaincode) DeleteMedicine(ctx contractapi.TransactionContextInterface, name string) (*Medicine, error) {
+	if err := recordInvocation(ctx, "DeleteMedicine"); err != nil {
+		return nil, err
+	}
+
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return archiveMedicine(ctx, name, caller)
+}
+
+// DeleteMedicines archives every named medicine in one transaction. If any
+// of them cannot be deleted the whole transaction fails and none are.
+func (c *PharmaChaincode) DeleteMedicines(ctx contractapi.TransactionContextInterface, names []string) ([]string, error) {
+	if err := recordInvocation(ctx, "DeleteMedicines"); err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no medicine names given")
+	}
+
+	// Reads in a transaction do not see its own writes, so a repeated name
+	// would pass the checks twice
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("medicine %s is listed more than once", name)
+		}
+		seen[name] = true
+	}
+
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make([]string, 0, len(names))
+	for _, name := range names {
+		_, err = archiveMedicine(ctx, name, caller)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete medicine %s: %v", name, err)
+		}
+		deleted = append(deleted, name)
+	}
+
+	return deleted, nil
+}
+
+func (c *PharmaChaincode) RestoreMedicine(ctx contractapi.TransactionContextInterface, name string) error {
+	if err := recordInvocation(ctx, "RestoreMedicine"); err != nil {
+		return err
+	}
+
+	medicine, err := readMedicineRecord(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !medicine.Deleted {
+		return fmt.Errorf("medicine %s is not archived", name)
+	}
+
+	// Only the owning organization or a regulator may restore the medicine
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner && caller != regulatorMSP {
+		return fmt.Errorf("only the owner %s may restore medicine %s", medicine.Owner, name)
+	}
+
+	// putMedicine sees no live previous record and re-creates the owner index
+	medicine.Deleted = false
+
+	return putMedicine(ctx, medicine)
+}
+
+// PurgeMedicine removes a medicine, live or archived, from the world state.
+// Only a regulator may purge, since it cannot be undone.
+func (c *PharmaChaincode) PurgeMedicine(ctx contractapi.TransactionContextInterface, name string) (*Medicine, error) {
+	if err := recordInvocation(ctx, "PurgeMedicine"); err != nil {
+		return nil, err
+	}
+
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller != regulatorMSP {
+		return nil, fmt.Errorf("only %s may purge medicine %s", regulatorMSP, name)
+	}
+
+	medicine, err := readMedicineRecord(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to purge a medicine that other organizations are still waiting on
+	requests, err := c.GetRequestsForMedicine(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) > 0 {
+		return nil, fmt.Errorf("medicine %s still has %d outstanding requests", name, len(requests))
+	}
+
+	// The record read above is returned as the final snapshot
+	err = deleteMedicine(ctx, medicine)
+	if err != nil {
+		return nil, err
+	}
+
+	return medicine, nil
+}
+
+// DeleteExpiredMedicines archives expired medicines like DeleteMedicine, so
+// they can still be restored; only PurgeMedicine removes them for good.
+func (c *PharmaChaincode) DeleteExpiredMedicines(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	if err := recordInvocation(ctx, "DeleteExpiredMedicines"); err != nil {
+		return nil, err
+	}
+
+	// A regulator archives expired stock across organizations, any other
+	// organization only its own
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Medicines other organizations still have open requests against are
+	// kept, like PurgeMedicine refuses them, so no request is orphaned
+	requests, err := activeRequests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	requested := make(map[string]bool)
+	for _, request := range requests {
+		requested[request.MedicineName] = true
+	}
+
+	// Archive every medicine that expired before the transaction time
+	var deleted []string
+	for _, medicine := range medicines {
+		if !medicine.ExpiryDate.Before(now) {
+			continue
+		}
+		if caller != regulatorMSP && caller != medicine.Owner {
+			continue
+		}
+		if requested[medicine.Name] {
+			continue
+		}
+		// Stock in a two-step handoff is left for the transfer to settle
+		if medicine.PendingOwner != "" {
+			continue
+		}
+
+		_, err = archiveMedicine(ctx, medicine.Name, caller)
+		if err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, medicine.Name)
+	}
+
+	if len(deleted) > 0 {
+		err = emitEvent(ctx, "MedicineExpired", deleted)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// DeleteAllExpired runs DeleteExpiredMedicines and reports only how many
+// medicines were archived
+func (c *PharmaChaincode) DeleteAllExpired(ctx contractapi.TransactionContextInterface) (int, error) {
+	deleted, err := c.DeleteExpiredMedicines(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(deleted), nil
+}
+
+func (c *PharmaChaincode) GetMedicine(ctx contractapi.TransactionContextInterface, name string) (*Medicine, error) {
+	return readMedicine(ctx, name)
+}
+
+// GetMedicineByID reads a medicine by its immutable ID rather than its name
+func (c *PharmaChaincode) GetMedicineByID(ctx contractapi.TransactionContextInterface, id string) (*Medicine, error) {
+	if id == "" {
+		return nil, fmt.Errorf("medicine ID must not be empty")
+	}
+
+	medicine, err := readMedicineKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Records written before IDs existed are keyed by name, not ID
+	if medicine.ID != id || medicine.Deleted {
+		return nil, fmt.Errorf("%w: no medicine with ID %s", ErrMedicineNotFound, id)
+	}
+
+	return medicine, nil
+}
+
+// GetExpiryStatus classifies a medicine as "expired", "expiring_soon" or
+// "ok" relative to the transaction timestamp.
+func (c *PharmaChaincode) GetExpiryStatus(ctx contractapi.TransactionContextInterface, name string) (string, error) {
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case medicine.ExpiryDate.Before(now):
+		return "expired", nil
+	case medicine.ExpiryDate.Before(now.Add(expiringSoonWindow)):
+		return "expiring_soon", nil
+	default:
+		return "ok", nil
+	}
+}
+
+func (c *PharmaChaincode) GetMedicineJSON(ctx contractapi.TransactionContextInterface, name string) (string, error) {
+	// Return the stored bytes untouched, without a round trip through Medicine
+	medicineJSON, err := getMedicineState(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if medicineJSON == nil {
+		return "", fmt.Errorf("%w: %s", ErrMedicineNotFound, name)
+	}
+
+	// Archived records and rename tombstones are hidden like in GetMedicine
+	var medicine Medicine
+	err = json.Unmarshal(medicineJSON, &medicine)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal medicine JSON: %v", err)
+	}
+	if medicine.RenamedTo != "" {
+		return "", fmt.Errorf("%w: %s was renamed to %s", ErrMedicineNotFound, name, medicine.RenamedTo)
+	}
+	if medicine.Deleted {
+		return "", fmt.Errorf("%w: %s is archived", ErrMedicineNotFound, name)
+	}
+
+	return string(medicineJSON), nil
+}
+
+func (c *PharmaChaincode) ListMedicines(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A nil slice marshals to null, but clients expect an array
+	if medicines == nil {
+		medicines = []*Medicine{}
+	}
+
+	// Sort the medicines by name in ascending order
+	sort.Slice(medicines, func(i, j int) bool {
+		return medicineLess(medicines[i], medicines[j])
+	})
+
+	return medicines, nil
+}
+
+// ListActiveMedicines is ListMedicines without the stock that has expired
+// by the transaction timestamp.
+func (c *PharmaChaincode) ListActiveMedicines(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	active := []*Medicine{}
+	for _, medicine := range medicines {
+		if medicine.ExpiryDate.Before(now) {
+			continue
+		}
+		active = append(active, medicine)
+	}
+
+	// Sort the medicines by name in ascending order
+	sort.Slice(active, func(i, j int) bool {
+		return medicineLess(active[i], active[j])
+	})
+
+	return active, nil
+}
+
+// GetMedicineKeys lists the names of medicine records without reading their
+// values. Archived medicines and rename tombstones keep their name, so they
+// are included.
+func (c *PharmaChaincode) GetMedicineKeys(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	// Records keyed by ID are listed under the names the name~id index maps
+	// to them
+	indexIterator, err := ledger(ctx).GetStateByPartialCompositeKey(nameIndexObjectType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get name index by partial composite key: %v", err)
+	}
+	defer indexIterator.Close()
+
+	names := map[string]bool{}
+	ids := map[string]bool{}
+	for indexIterator.HasNext() {
+		queryResponse, err := indexIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over query results: %v", err)
+		}
+
+		_, attributes, err := ledger(ctx).SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split name index key: %v", err)
+		}
+		names[attributes[0]] = true
+		ids[attributes[1]] = true
+	}
+
+	// Range scans skip composite keys, so request, serial, index and other
+	// auxiliary records never appear here. Keys the index does not know are
+	// records written before IDs existed, which are keyed by their name.
+	resultsIterator, err := ledger(ctx).GetStateByRange("", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state by range: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over query results: %v", err)
+		}
+
+		if !ids[queryResponse.Key] {
+			names[queryResponse.Key] = true
+		}
+	}
+
+	keys := make([]string, 0, len(names))
+	for name := range names {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (c *PharmaChaincode) ListMedicinesJSON(ctx contractapi.TransactionContextInterface) (string, error) {
+	medicines, err := c.ListMedicines(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	medicinesJSON, err := json.Marshal(medicines)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal medicines to JSON: %v", err)
+	}
+
+	return string(medicinesJSON), nil
+}
+
+func (c *PharmaChaincode) ListMedicinesByCategory(ctx contractapi.TransactionContextInterface, category string) ([]*Medicine, error) {
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the medicines in the requested category. A nil slice marshals
+	// to null, but clients expect an array.
+	matching := []*Medicine{}
+	for _, medicine := range medicines {
+		if medicine.Category == category {
+			matching = append(matching, medicine)
+		}
+	}
+
+	// Sort the medicines by name in ascending order
+	sort.Slice(matching, func(i, j int) bool {
+		return medicineLess(matching[i], matching[j])
+	})
+
+	return matching, nil
+}
+
+// ListMedicinesBelowThreshold is the reorder report: medicines whose stock is
+// at or below their minimum stock level
+func (c *PharmaChaincode) ListMedicinesBelowThreshold(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+	return lowStockMedicines(ctx, true)
+}
+
+// GetLowStockMedicines is the shortage report: medicines whose stock is
+// strictly below their minimum stock level. Stock exactly at the level is due
+// for reorder but not yet short, so it is only in ListMedicinesBelowThreshold.
+func (c *PharmaChaincode) GetLowStockMedicines(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+	return lowStockMedicines(ctx, false)
+}
+
+func (c *PharmaChaincode) GetOwners(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	// Auxiliary records live under composite keys, which range scans skip,
+	// so only medicines are counted here
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the distinct owning organizations
+	ownerSet := make(map[string]bool)
+	for _, medicine := range medicines {
+		ownerSet[medicine.Owner] = true
+	}
+
+	owners := make([]string, 0, len(ownerSet))
+	for owner := range ownerSet {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	return owners, nil
+}
+
+func (c *PharmaChaincode) GetInventorySummary(ctx contractapi.TransactionContextInterface) (*InventorySummary, error) {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Quantities in different units cannot be added, so total them per unit
+	summary := &InventorySummary{
+		TotalMedicines:       len(medicines),
+		ActiveQuantityByUnit: make(map[string]int),
+	}
+	for _, medicine := range medicines {
+		if medicine.ExpiryDate.Before(now) {
+			summary.Expired++
+			continue
+		}
+		quantity, err := availableQuantity(ctx, medicine)
+		if err != nil {
+			return nil, err
+		}
+		summary.ActiveQuantityByUnit[medicine.Unit] += quantity
+	}
+
+	return summary, nil
+}
+
+func (c *PharmaChaincode) GetExpiryBuckets(ctx contractapi.TransactionContextInterface) (*ExpiryBuckets, error) {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := &ExpiryBuckets{
+		Expired:      ExpiryBucket{QuantityByUnit: make(map[string]int)},
+		Within30Days: ExpiryBucket{QuantityByUnit: make(map[string]int)},
+		Within90Days: ExpiryBucket{QuantityByUnit: make(map[string]int)},
+		Beyond90Days: ExpiryBucket{QuantityByUnit: make(map[string]int)},
+	}
+	for _, medicine := range medicines {
+		var bucket *ExpiryBucket
+		switch {
+		case medicine.ExpiryDate.Before(now):
+			bucket = &buckets.Expired
+		case medicine.ExpiryDate.Before(now.Add(expiryBucketNear)):
+			bucket = &buckets.Within30Days
+		case medicine.ExpiryDate.Before(now.Add(expiryBucketMid)):
+			bucket = &buckets.Within90Days
+		default:
+			bucket = &buckets.Beyond90Days
+		}
+
+		quantity, err := availableQuantity(ctx, medicine)
+		if err != nil {
+			return nil, err
+		}
+
+		bucket.Count++
+		bucket.QuantityByUnit[medicine.Unit] += quantity
+	}
+
+	return buckets, nil
+}
+
+func (c *PharmaChaincode) ExportLedgerSnapshot(ctx contractapi.TransactionContextInterface) (string, error) {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Range scans never return composite keys, so requests and indexes are
+	// left out
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// A nil slice marshals to null, but clients expect an array
+	if medicines == nil {
+		medicines = []*Medicine{}
+	}
+
+	snapshot := LedgerSnapshot{
+		Timestamp: now,
+		Count:     len(medicines),
+		Medicines: medicines,
+	}
+
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal ledger snapshot to JSON: %v", err)
+	}
+
+	return string(snapshotJSON), nil
+}
+
+// GetTotalInventoryValue sums price times quantity over unexpired medicines
+// priced in the given currency. Medicines priced in other currencies, or not
+// priced at all, are skipped rather than converted.
+func (c *PharmaChaincode) GetTotalInventoryValue(ctx contractapi.TransactionContextInterface, currency string) (float64, error) {
+	err := validateCurrency(currency)
+	if err != nil {
+		return 0, err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total float64
+	for _, medicine := range medicines {
+		if medicine.Currency != currency || medicine.ExpiryDate.Before(now) {
+			continue
+		}
+		quantity, err := availableQuantity(ctx, medicine)
+		if err != nil {
+			return 0, err
+		}
+		total += medicine.Price * float64(quantity)
+	}
+
+	return total, nil
+}
+
+func (c *PharmaChaincode) GetMedicinesModifiedSince(ctx contractapi.TransactionContextInterface, sinceRFC3339 string) ([]*Medicine, error) {
+	sinceTime, err := parseDate("since", sinceRFC3339)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if sinceTime.After(now) {
+		return nil, fmt.Errorf("since %s is after the transaction time %s", sinceRFC3339, now.Format(time.RFC3339))
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	modified := []*Medicine{}
+	for _, medicine := range medicines {
+		if medicine.LastModifiedAt.Before(sinceTime) {
+			continue
+		}
+		modified = append(modified, medicine)
+	}
+
+	// Sort the medicines by modification time in ascending order
+	sort.Slice(modified, func(i, j int) bool {
+		if !modified[i].LastModifiedAt.Equal(modified[j].LastModifiedAt) {
+			return modified[i].LastModifiedAt.Before(modified[j].LastModifiedAt)
+		}
+		return medicineLess(modified[i], modified[j])
+	})
+
+	return modified, nil
+}
+
+func (c *PharmaChaincode) GetMedicinesByExpiryRange(ctx contractapi.TransactionContextInterface, startDate string, endDate string) ([]*Medicine, error) {
+	// Parse the range bounds
+	startTime, err := parseDate("start date", startDate)
+	if err != nil {
+		return nil, err
+	}
+
+	endTime, err := parseDate("end date", endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	if startTime.After(endTime) {
+		return nil, fmt.Errorf("start date %s is after end date %s", startDate, endDate)
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the medicines expiring within the inclusive range
+	var expiring []*Medicine
+	for _, medicine := range medicines {
+		if medicine.ExpiryDate.Before(startTime) || medicine.ExpiryDate.After(endTime) {
+			continue
+		}
+		expiring = append(expiring, medicine)
+	}
+
+	// Sort the medicines by expiry date in ascending order
+	sort.Slice(expiring, func(i, j int) bool {
+		if !expiring[i].ExpiryDate.Equal(expiring[j].ExpiryDate) {
+			return expiring[i].ExpiryDate.Before(expiring[j].ExpiryDate)
+		}
+		return medicineLess(expiring[i], expiring[j])
+	})
+
+	return expiring, nil
+}
+
+// GetExpiringSoonByOwner lists an owner's medicines that have not expired yet
+// but will before the cutoff. An empty owner means the caller.
+func (c *PharmaChaincode) GetExpiringSoonByOwner(ctx contractapi.TransactionContextInterface, owner string, cutoffDate string) ([]*Medicine, error) {
+	cutoffTime, err := parseDate("cutoff date", cutoffDate)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner == "" {
+		owner, err = requireCallerOrg(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var expiring []*Medicine
+	for _, medicine := range medicines {
+		if medicine.Owner != owner {
+			continue
+		}
+		if medicine.ExpiryDate.Before(now) || !medicine.ExpiryDate.Before(cutoffTime) {
+			continue
+		}
+		expiring = append(expiring, medicine)
+	}
+
+	// Sort the medicines by expiry date in ascending order
+	sort.Slice(expiring, func(i, j int) bool {
+		if !expiring[i].ExpiryDate.Equal(expiring[j].ExpiryDate) {
+			return expiring[i].ExpiryDate.Before(expiring[j].ExpiryDate)
+		}
+		return medicineLess(expiring[i], expiring[j])
+	})
+
+	return expiring, nil
+}
+
+// SearchMedicines returns the medicines matching every criterion set in
+// filterJSON, in a single scan of the world state.
+func (c *PharmaChaincode) SearchMedicines(ctx contractapi.TransactionContextInterface, filterJSON string) ([]*Medicine, error) {
+	var filter medicineFilter
+	err := json.Unmarshal([]byte(filterJSON), &filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal filter JSON: %v", err)
+	}
+
+	var expiringBefore time.Time
+	if filter.ExpiringBeforeRFC3339 != "" {
+		expiringBefore, err = parseDate("expiring before date", filter.ExpiringBeforeRFC3339)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if filter.MinQuantity < 0 {
+		return nil, fmt.Errorf("minimum quantity must not be negative, got %d", filter.MinQuantity)
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A nil slice marshals to null, but clients expect an array
+	matching := []*Medicine{}
+	for _, medicine := range medicines {
+		if filter.Owner != "" && medicine.Owner != filter.Owner {
+			continue
+		}
+		if filter.Category != "" && medicine.Category != filter.Category {
+			continue
+		}
+		if !expiringBefore.IsZero() && !medicine.ExpiryDate.Before(expiringBefore) {
+			continue
+		}
+		quantity, err := availableQuantity(ctx, medicine)
+		if err != nil {
+			return nil, err
+		}
+		if quantity < filter.MinQuantity {
+			continue
+		}
+		matching = append(matching, medicine)
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return medicineLess(matching[i], matching[j])
+	})
+
+	return matching, nil
+}
+
+func (c *PharmaChaincode) QueryByManufactureRange(ctx contractapi.TransactionContextInterface, fromRFC3339 string, toRFC3339 string) ([]*Medicine, error) {
+	// Parse the range bounds
+	fromTime, err := parseDate("from date", fromRFC3339)
+	if err != nil {
+		return nil, err
+	}
+
+	toTime, err := parseDate("to date", toRFC3339)
+	if err != nil {
+		return nil, err
+	}
+
+	if fromTime.After(toTime) {
+		return nil, fmt.Errorf("from date %s is after to date %s", fromRFC3339, toRFC3339)
+	}
+
+	// Narrow the candidates with a CouchDB range selector
+	query := map[string]interface{}{
+		"selector": map[string]interface{}{
+			"manufactureDate": map[string]interface{}{
+				"$gte": fromTime,
+				"$lte": toTime,
+			},
+		},
+	}
+	queryJSON, err := json.Marshal(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal query: %v", err)
+	}
+
+	inRange := func(medicine *Medicine) bool {
+		return !medicine.ManufactureDate.Before(fromTime) && !medicine.ManufactureDate.After(toTime)
+	}
+
+	candidates, err := queryMedicinesOrScan(ctx, string(queryJSON), inRange)
+	if err != nil {
+		return nil, err
+	}
+
+	// CouchDB compares the dates as strings, so check the parsed times as well
+	manufactured := []*Medicine{}
+	for _, medicine := range candidates {
+		if inRange(medicine) {
+			manufactured = append(manufactured, medicine)
+		}
+	}
+
+	// Sort the medicines by manufacture date in ascending order
+	sort.Slice(manufactured, func(i, j int) bool {
+		if !manufactured[i].ManufactureDate.Equal(manufactured[j].ManufactureDate) {
+			return manufactured[i].ManufactureDate.Before(manufactured[j].ManufactureDate)
+		}
+		return medicineLess(manufactured[i], manufactured[j])
+	})
+
+	return manufactured, nil
+}
+
+// GetMedicinesManufacturedBetween is an alias of QueryByManufactureRange
+func (c *PharmaChaincode) GetMedicinesManufacturedBetween(ctx contractapi.TransactionContextInterface, startDate string, endDate string) ([]*Medicine, error) {
+	return c.QueryByManufactureRange(ctx, startDate, endDate)
+}
+
+func (c *PharmaChaincode) QueryMedicinesByOwner(ctx contractapi.TransactionContextInterface, owner string) ([]*Medicine, error) {
+	queryString, err := buildSelector("owner", owner)
+	if err != nil {
+		return nil, err
+	}
+
+	medicines, err := queryMedicinesOrScan(ctx, queryString, func(medicine *Medicine) bool {
+		return medicine.Owner == owner
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort the medicines by name in ascending order
+	sort.Slice(medicines, func(i, j int) bool {
+		return medicineLess(medicines[i], medicines[j])
+	})
+
+	return medicines, nil
+}
+
+func (c *PharmaChaincode) QueryMedicinesByCategory(ctx contractapi.TransactionContextInterface, category string) ([]*Medicine, error) {
+	queryString, err := buildSelector("category", category)
+	if err != nil {
+		return nil, err
+	}
+
+	medicines, err := queryMedicinesOrScan(ctx, queryString, func(medicine *Medicine) bool {
+		return medicine.Category == category
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A nil slice marshals to null, but clients expect an array
+	if medicines == nil {
+		medicines = []*Medicine{}
+	}
+
+	// Sort the medicines by name in ascending order
+	sort.Slice(medicines, func(i, j int) bool {
+		return medicineLess(medicines[i], medicines[j])
+	})
+
+	return medicines, nil
+}
+
+// ListMedicinesByOwnerIndexed resolves an owner's medicines through the
+// owner~name index. Medicines written before the index existed are only
+// indexed once they are next updated.
+func (c *PharmaChaincode) ListMedicinesByOwnerIndexed(ctx contractapi.TransactionContextInterface, owner string) ([]*Medicine, error) {
+	resultsIterator, err := ledger(ctx).GetStateByPartialCompositeKey(ownerIndexObjectType, []string{owner})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get owner index by partial composite key: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	// Index keys come back ordered by name for the given owner
+	var medicines []*Medicine
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over query results: %v", err)
+		}
+
+		_, attributes, err := ledger(ctx).SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split owner index key: %v", err)
+		}
+
+		// A stale entry for an archived, renamed, purged or since transferred
+		// medicine is skipped rather than failing the whole listing
+		medicine, err := readMedicine(ctx, attributes[1])
+		if errors.Is(err, ErrMedicineNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if medicine.Owner != owner {
+			continue
+		}
+
+		medicines = append(medicines, medicine)
+	}
+
+	return medicines, nil
+}
+
+// QueryMedicinesWithSelector runs a client-supplied CouchDB query and only
+// works on peers using CouchDB as the state database; on other peers it fails
+// with ErrRichQueryUnsupported. Auxiliary records under
+// composite keys are skipped; any other document matched by the selector is
+// decoded as a Medicine, so selectors should target medicine fields.
+func (c *PharmaChaincode) QueryMedicinesWithSelector(ctx contractapi.TransactionContextInterface, queryString string) ([]*Medicine, error) {
+	return queryMedicines(ctx, queryString)
+}
+
+func (c *PharmaChaincode) ShowMedicineHistory(ctx contractapi.TransactionContextInterface, name string) ([]*MedicineHistory, error) {
+	medicineHistory, err := getMedicineHistory(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// A nil slice marshals to null, but clients expect an array
+	if medicineHistory == nil {
+		medicineHistory = []*MedicineHistory{}
+	}
+
+	return medicineHistory, nil
+}
+
+func (c *PharmaChaincode) ShowMedicineHistoryJSON(ctx contractapi.TransactionContextInterface, name string) (string, error) {
+	history, err := getMedicineHistory(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	// Start from an empty slice so no history marshals to [] rather than null
+	views := []medicineHistoryView{}
+	for _, entry := range history {
+		views = append(views, medicineHistoryView{
+			TxID:      entry.TxID,
+			Value:     entry.Value,
+			Timestamp: entry.Timestamp.UTC().Format(time.RFC3339),
+			IsDelete:  entry.IsDelete,
+		})
+	}
+
+	historyJSON, err := json.Marshal(views)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal medicine history to JSON: %v", err)
+	}
+
+	return string(historyJSON), nil
+}
+
+// GetMedicineWithHistory returns a not-found error for a medicine that has
+// been deleted, even though its key still has history from before deletion.
+func (c *PharmaChaincode) GetMedicineWithHistory(ctx contractapi.TransactionContextInterface, name string) (*MedicineDetail, error) {
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	medicineHistory, err := getMedicineHistory(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MedicineDetail{
+		Medicine: medicine,
+		History:  medicineHistory,
+	}, nil
+}
+
+func (c *PharmaChaincode) GetMedicineWithRequests(ctx contractapi.TransactionContextInterface, name string) (*MedicineDetail, error) {
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	requests, err := c.GetRequestsForMedicine(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MedicineDetail{
+		Medicine: medicine,
+		Requests: requests,
+	}, nil
+}
+
+func (c *PharmaChaincode) GetMedicineAtTime(ctx contractapi.TransactionContextInterface, name string, atRFC3339 string) (*Medicine, error) {
+	// Parse the point in time to reconstruct
+	at, err := parseDate("time", atRFC3339)
+	if err != nil {
+		return nil, err
+	}
+
+	medicineHistory, err := getMedicineHistory(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the latest history entry written at or before the requested time
+	var latest *MedicineHistory
+	for _, entry := range medicineHistory {
+		if entry.Timestamp.After(at) {
+			continue
+		}
+		if latest == nil || entry.Timestamp.After(latest.Timestamp) {
+			latest = entry
+		}
+	}
+
+	if latest == nil {
+		return nil, fmt.Errorf("%w: %s did not exist at %s", ErrMedicineNotFound, name, atRFC3339)
+	}
+	if latest.IsDelete {
+		return nil, fmt.Errorf("%w: %s was deleted at %s", ErrMedicineNotFound, name, latest.Timestamp.Format(time.RFC3339))
+	}
+
+	// Archiving and renaming write a record instead of a delete marker
+	if latest.Value.Deleted {
+		return nil, fmt.Errorf("%w: %s was archived at %s", ErrMedicineNotFound, name, latest.Timestamp.Format(time.RFC3339))
+	}
+	if latest.Value.RenamedTo != "" {
+		return nil, fmt.Errorf("%w: %s was renamed to %s at %s", ErrMedicineNotFound, name, latest.Value.RenamedTo, latest.Timestamp.Format(time.RFC3339))
+	}
+
+	medicine := latest.Value
+	return &medicine, nil
+}
+
+// GetMedicineAsOf is an alias of GetMedicineAtTime
+func (c *PharmaChaincode) GetMedicineAsOf(ctx contractapi.TransactionContextInterface, name string, timestamp string) (*Medicine, error) {
+	return c.GetMedicineAtTime(ctx, name, timestamp)
+}
+
+// GetOwnershipTrail follows PreviousName links back through renames, so the
+// trail starts at the medicine's original key.
+func (c *PharmaChaincode) GetOwnershipTrail(ctx contractapi.TransactionContextInterface, name string) ([]OwnershipChange, error) {
+	medicineHistory, err := getMedicineHistory(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk the history oldest first
+	sort.SliceStable(medicineHistory, func(i, j int) bool {
+		return medicineHistory[i].Timestamp.Before(medicineHistory[j].Timestamp)
+	})
+
+	// Start from the trail of the key this medicine was renamed from
+	var trail []OwnershipChange
+	previousOwner := ""
+	for _, entry := range medicineHistory {
+		if entry.IsDelete {
+			continue
+		}
+		if entry.Value.PreviousName != "" {
+			trail, err = c.GetOwnershipTrail(ctx, entry.Value.PreviousName)
+			if err != nil {
+				return nil, err
+			}
+			if len(trail) > 0 {
+				previousOwner = trail[len(trail)-1].To
+			}
+		}
+		break
+	}
+
+	// Record every snapshot whose owner differs from the one before it
+	for _, entry := range medicineHistory {
+		if entry.IsDelete {
+			previousOwner = ""
+			continue
+		}
+		if entry.Value.Owner == previousOwner {
+			continue
+		}
+
+		trail = append(trail, OwnershipChange{
+			From:      previousOwner,
+			To:        entry.Value.Owner,
+			TxID:      entry.TxID,
+			Timestamp: entry.Timestamp,
+		})
+		previousOwner = entry.Value.Owner
+	}
+
+	return trail, nil
+}
+
+// GetMedicineProvenanceGraph returns the lineage tree that name belongs to,
+// rooted at the original record. Split and returned lots point at the lot
+// they came from, and rename tombstones at the record that replaced them.
+func (c *PharmaChaincode) GetMedicineProvenanceGraph(ctx contractapi.TransactionContextInterface, name string) (*ProvenanceNode, error) {
+	records, err := getMedicineRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*Medicine, len(records))
+	renamedFrom := make(map[string]string)
+	children := make(map[string][]string)
+	for _, record := range records {
+		byName[record.Name] = record
+		if record.SplitFrom != "" {
+			children[record.SplitFrom] = append(children[record.SplitFrom], record.Name)
+		}
+		if record.RenamedTo != "" {
+			renamedFrom[record.RenamedTo] = record.Name
+			children[record.Name] = append(children[record.Name], record.RenamedTo)
+		}
+	}
+
+	if byName[name] == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMedicineNotFound, name)
+	}
+
+	// Walk up to the original record
+	root := name
+	visited := map[string]bool{root: true}
+	for {
+		parent := byName[root].SplitFrom
+		if previous, ok := renamedFrom[root]; ok {
+			parent = previous
+		}
+		if parent == "" || byName[parent] == nil || visited[parent] {
+			break
+		}
+		root = parent
+		visited[root] = true
+	}
+
+	// Build the tree downwards, guarding against malformed parent pointers
+	built := make(map[string]bool)
+	var build func(name string, relation string) *ProvenanceNode
+	build = func(name string, relation string) *ProvenanceNode {
+		built[name] = true
+		record := byName[name]
+		node := &ProvenanceNode{
+			Name:     record.Name,
+			Owner:    record.Owner,
+			Quantity: record.Quantity,
+			Relation: relation,
+			Renamed:  record.RenamedTo != "",
+			Deleted:  record.Deleted,
+		}
+
+		childNames := children[name]
+		sort.Strings(childNames)
+		for _, childName := range childNames {
+			if built[childName] || byName[childName] == nil {
+				continue
+			}
+			childRelation := "split"
+			if childName == record.RenamedTo {
+				childRelation = "renamed"
+			}
+			node.Children = append(node.Children, build(childName, childRelation))
+		}
+
+		return node
+	}
+
+	return build(root, ""), nil
+}
+
+func (c *PharmaChaincode) VerifyMedicineHistory(ctx contractapi.TransactionContextInterface, name string) (*HistoryReport, error) {
+	medicineHistory, err := getMedicineHistory(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &HistoryReport{
+		Name:       name,
+		Versions:   len(medicineHistory),
+		Violations: []HistoryViolation{},
+	}
+
+	// Fabric returns history in commit order, newest first on current peers.
+	// Walk it oldest first without re-sorting so ordering problems stay visible.
+	if len(medicineHistory) > 1 && medicineHistory[0].Timestamp.After(medicineHistory[len(medicineHistory)-1].Timestamp) {
+		for i, j := 0, len(medicineHistory)-1; i < j; i, j = i+1, j-1 {
+			medicineHistory[i], medicineHistory[j] = medicineHistory[j], medicineHistory[i]
+		}
+	}
+
+	var previous *MedicineHistory
+	var previousTimestamp time.Time
+	for _, entry := range medicineHistory {
+		addViolation := func(reason string) {
+			report.Violations = append(report.Violations, HistoryViolation{
+				TxID:      entry.TxID,
+				Timestamp: entry.Timestamp,
+				Reason:    reason,
+			})
+		}
+
+		if entry.Timestamp.Before(previousTimestamp) {
+			addViolation(fmt.Sprintf("timestamp %s is earlier than the previous version at %s", entry.Timestamp.Format(time.RFC3339), previousTimestamp.Format(time.RFC3339)))
+		}
+		previousTimestamp = entry.Timestamp
+
+		// A deleted key may be recreated with unrelated values
+		if entry.IsDelete {
+			previous = nil
+			continue
+		}
+
+		if entry.Value.Quantity < 0 {
+			addViolation(fmt.Sprintf("quantity %d is negative", entry.Value.Quantity))
+		}
+
+		// ExtendExpiry only ever moves the expiry later
+		if previous != nil && entry.Value.ExpiryDate.Before(previous.Value.ExpiryDate) {
+			addViolation(fmt.Sprintf("expiry %s is earlier than the previous expiry %s", entry.Value.ExpiryDate.Format(time.RFC3339), previous.Value.ExpiryDate.Format(time.RFC3339)))
+		}
+
+		previous = entry
+	}
+
+	return report, nil
+}
+
+func getMedicineHistory(ctx contractapi.TransactionContextInterface, name string) ([]*MedicineHistory, error) {
+	keys, err := medicineHistoryKeys(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var medicineHistory []*MedicineHistory
+	for _, key := range keys {
+		keyHistory, err := getKeyHistory(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		// An ID keeps its key across a rename, so only take the entries
+		// written while the record had this name. A delete marker belongs
+		// to the name of the value it removed.
+		sort.SliceStable(keyHistory, func(i, j int) bool {
+			return keyHistory[i].Timestamp.Before(keyHistory[j].Timestamp)
+		})
+		currentName := ""
+		for _, entry := range keyHistory {
+			if !entry.IsDelete {
+				currentName = entry.Value.Name
+			}
+			if currentName == name {
+				medicineHistory = append(medicineHistory, entry)
+			}
+		}
+	}
+
+	// Merge the keys newest first, the order the peer returns one key in
+	sort.SliceStable(medicineHistory, func(i, j int) bool {
+		return medicineHistory[i].Timestamp.After(medicineHistory[j].Timestamp)
+	})
+
+	return medicineHistory, nil
+}
+
+func getKeyHistory(ctx contractapi.TransactionContextInterface, key string) ([]*MedicineHistory, error) {
+	// Get the history of the key
+	resultsIterator, err := ledger(ctx).GetHistoryForKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history for key %s: %v", key, err)
+	}
+	defer resultsIterator.Close()
+
+	// Iterate through the results and unmarshal the history
+	var keyHistory []*MedicineHistory
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over history query results: %v", err)
+		}
+
+		// Delete markers carry no value to unmarshal
+		var txValue Medicine
+		if !queryResponse.IsDelete {
+			err = json.Unmarshal(queryResponse.Value, &txValue)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal medicine JSON from history: %v", err)
+			}
+		}
+
+		historyEntry := &MedicineHistory{
+			TxID:      queryResponse.TxId,
+			Value:     txValue,
+			Timestamp: queryResponse.Timestamp.AsTime(),
+			IsDelete:  queryResponse.IsDelete,
+		}
+
+		keyHistory = append(keyHistory, historyEntry)
+	}
+
+	return keyHistory, nil
+}
+
+func (c *PharmaChaincode) RequestMedicine(ctx contractapi.TransactionContextInterface, name string, details string, quantity int) (*MedicineRequest, error) {
+	if err := recordInvocation(ctx, "RequestMedicine"); err != nil {
+		return nil, err
+	}
+
+	request, _, err := createRequest(ctx, name, details, "", quantity)
+	return request, err
+}
+
+// RequestMedicineOrUpdate amends the caller's latest open request for the
+// medicine with new details and quantity, or creates a request if the caller
+// has none. Requests made with RequestMedicinePrivate are never amended, as
+// their details live in the private collection. RequestMedicine stays
+// create-only.
+func (c *PharmaChaincode) RequestMedicineOrUpdate(ctx contractapi.TransactionContextInterface, name string, details string, quantity int) error {
+	if err := recordInvocation(ctx, "RequestMedicineOrUpdate"); err != nil {
+		return err
+	}
+
+	requester, err := checkRequest(ctx, name, quantity)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Request keys contain the requester, so only the caller's own requests
+	// are found here
+	existingRequests, err := queryRequests(ctx, requester, name)
+	if err != nil {
+		return err
+	}
+
+	var latest *MedicineRequest
+	for _, request := range existingRequests {
+		if now.After(request.ExpiresAt) || request.DetailsHash != "" {
+			continue
+		}
+		if latest == nil || request.ExpiresAt.After(latest.ExpiresAt) || (request.ExpiresAt.Equal(latest.ExpiresAt) && request.ID > latest.ID) {
+			latest = request
+		}
+	}
+
+	if latest == nil {
+		_, _, err = createRequest(ctx, name, details, "", quantity)
+		return err
+	}
+
+	latest.Details = details
+	latest.Quantity = quantity
+
+	key, err := requestKey(ctx, latest)
+	if err != nil {
+		return err
+	}
+
+	requestJSON, err := json.Marshal(latest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request to JSON: %v", err)
+	}
+
+	err = ledger(ctx).PutState(key, requestJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return writeAudit(ctx, name)
+}
+
+func (c *PharmaChaincode) RequestMedicinePrivate(ctx contractapi.TransactionContextInterface, name string, quantity int) (*MedicineRequest, error) {
+	if err := recordInvocation(ctx, "RequestMedicinePrivate"); err != nil {
+		return nil, err
+	}
+
+	// Sensitive details travel in the transient map so they never reach the block
+	transient, err := ledger(ctx).GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient data: %v", err)
+	}
+	details, ok := transient[requestDetailsTransientKey]
+	if !ok || len(details) == 0 {
+		return nil, fmt.Errorf("request details must be passed in the transient field '%s'", requestDetailsTransientKey)
+	}
+	salt := transient[requestSaltTransientKey]
+	if len(salt) < minRequestSaltLength {
+		return nil, fmt.Errorf("a salt of at least %d bytes must be passed in the transient field '%s'", minRequestSaltLength, requestSaltTransientKey)
+	}
+
+	// Only a hash of the details is kept on the public ledger. Details such
+	// as a ward and a quantity are easy to guess, so an unsalted hash could
+	// be reversed by trying candidates; the salt stays with the requester.
+	hash := sha256.Sum256(append(append([]byte{}, salt...), details...))
+	detailsHash := hex.EncodeToString(hash[:])
+
+	request, key, err := createRequest(ctx, name, "", detailsHash, quantity)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ledger(ctx).PutPrivateData(requestDetailsCollection, key, details)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put private data: %v", err)
+	}
+
+	return request, nil
+}
+
+func (c *PharmaChaincode) GetRequestDetails(ctx contractapi.TransactionContextInterface, requester string, name string, requestID string) (string, error) {
+	key, err := requestKey(ctx, &MedicineRequest{ID: requestID, MedicineName: name, Requester: requester})
+	if err != nil {
+		return "", err
+	}
+
+	details, err := ledger(ctx).GetPrivateData(requestDetailsCollection, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get private data: %v", err)
+	}
+	if details == nil {
+		return "", fmt.Errorf("no private details for request %s", requestID)
+	}
+
+	return string(details), nil
+}
+
+func (c *PharmaChaincode) ListRequests(ctx contractapi.TransactionContextInterface) ([]*MedicineRequest, error) {
+	requests, err := activeRequests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A nil slice marshals to null, but clients expect an array
+	if requests == nil {
+		requests = []*MedicineRequest{}
+	}
+
+	return requests, nil
+}
+
+func (c *PharmaChaincode) GetRequestsForMedicine(ctx contractapi.TransactionContextInterface, name string) ([]*MedicineRequest, error) {
+	return requestsForMedicine(ctx, name)
+}
+
+// ApproveRequest lets the owner of a medicine accept an unexpired request for
+// quantity units of it, or for the requested quantity if quantity is 0.
+// Approval closes the request, so it no longer counts as outstanding; the
+// approved units are shipped separately with SplitMedicine or
+// InitiateTransfer.
+func (c *PharmaChaincode) ApproveRequest(ctx contractapi.TransactionContextInterface, requester string, name string, requestID string, quantity int) (*MedicineRequest, error) {
+	if err := recordInvocation(ctx, "ApproveRequest"); err != nil {
+		return nil, err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the owning organization may approve requests for the medicine
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller != medicine.Owner {
+		return nil, fmt.Errorf("only the owner %s may approve requests for medicine %s", medicine.Owner, name)
+	}
+
+	key, err := requestKey(ctx, &MedicineRequest{ID: requestID, MedicineName: name, Requester: requester})
+	if err != nil {
+		return nil, err
+	}
+	requestJSON, err := ledger(ctx).GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if requestJSON == nil {
+		return nil, fmt.Errorf("request %s for medicine %s not found", requestID, name)
+	}
+
+	var request MedicineRequest
+	err = json.Unmarshal(requestJSON, &request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal request JSON: %v", err)
+	}
+
+	// Expiry is judged at the transaction time so every peer agrees
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.After(request.ExpiresAt) {
+		return nil, fmt.Errorf("request expired at %s", request.ExpiresAt.Format(time.RFC3339))
+	}
+
+	err = checkNotQuarantined(medicine)
+	if err != nil {
+		return nil, err
+	}
+
+	if quantity == 0 {
+		quantity = request.Quantity
+	}
+	available, err := availableQuantity(ctx, medicine)
+	if err != nil {
+		return nil, err
+	}
+	if quantity <= 0 || quantity > available {
+		return nil, fmt.Errorf("approved quantity %d must be between 1 and %d", quantity, available)
+	}
+	request.Quantity = quantity
+
+	err = ledger(ctx).DelState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete request %s: %v", requestID, err)
+	}
+
+	err = writeAudit(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(ctx, "RequestApproved", request)
+	if err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+func (c *PharmaChaincode) PurgeExpiredRequests(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	if err := recordInvocation(ctx, "PurgeExpiredRequests"); err != nil {
+		return nil, err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	requests, err := queryRequests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete every expired request and report the IDs that were removed
+	var purged []string
+	for _, request := range requests {
+		if !now.After(request.ExpiresAt) {
+			continue
+		}
+
+		key, err := requestKey(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ledger(ctx).DelState(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete request %s: %v", request.ID, err)
+		}
+		purged = append(purged, request.ID)
+	}
+
+	return purged, nil
+}
+
+// PurgeExpiredIdempotencyKeys removes the caller's idempotency keys that are
+// past idempotencyTTL and returns how many were removed.
+func (c *PharmaChaincode) PurgeExpiredIdempotencyKeys(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := recordInvocation(ctx, "PurgeExpiredIdempotencyKeys"); err != nil {
+		return 0, err
+	}
+
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	records, err := queryComposite[idempotencyRecord](ctx, idempotencyObjectType, []string{caller})
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, record := range records {
+		if !now.After(record.ExpiresAt) {
+			continue
+		}
+
+		key, err := ledger(ctx).CreateCompositeKey(idempotencyObjectType, []string{record.Caller, record.Key})
+		if err != nil {
+			return 0, fmt.Errorf("failed to create idempotency key: %v", err)
+		}
+
+		err = ledger(ctx).DelState(key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete idempotency key %s: %v", record.Key, err)
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+func (c *PharmaChaincode) RegisterSerial(ctx contractapi.TransactionContextInterface, name string, serial string) error {
+	if err := recordInvocation(ctx, "RegisterSerial"); err != nil {
+		return err
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may serialize its stock
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may register serials for medicine %s", medicine.Owner, name)
+	}
+
+	if !medicine.ControlledSubstance {
+		return fmt.Errorf("medicine %s is not a controlled substance", name)
+	}
+
+	err = validateKeyPart("serial", serial)
+	if err != nil {
+		return err
+	}
+
+	key, err := ledger(ctx).CreateCompositeKey(serialObjectType, []string{name, serial})
+	if err != nil {
+		return fmt.Errorf("failed to create serial key: %v", err)
+	}
+
+	// Check if the serial is already registered
+	existingSerial, err := ledger(ctx).GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingSerial != nil {
+		return fmt.Errorf("serial %s is already registered for medicine %s", serial, name)
+	}
+
+	// The new serial is active, so there must be room for one more
+	err = checkSerialCapacity(ctx, medicine, 1)
+	if err != nil {
+		return err
+	}
+
+	unit := &SerializedUnit{
+		Serial:       serial,
+		MedicineName: name,
+		Status:       serialStatusActive,
+	}
+
+	return putSerial(ctx, key, unit)
+}
+
+func (c *PharmaChaincode) UpdateSerialStatus(ctx contractapi.TransactionContextInterface, name string, serial string, status string) error {
+	if err := recordInvocation(ctx, "UpdateSerialStatus"); err != nil {
+		return err
+	}
+
+	if !allowedSerialStatuses[status] {
+		return fmt.Errorf("serial status %q is not one of active, dispensed, destroyed", status)
+	}
+
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Only the owning organization may change the status of its units
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != medicine.Owner {
+		return fmt.Errorf("only the owner %s may update serials for medicine %s", medicine.Owner, name)
+	}
+
+	key, err := ledger(ctx).CreateCompositeKey(serialObjectType, []string{name, serial})
+	if err != nil {
+		return fmt.Errorf("failed to create serial key: %v", err)
+	}
+
+	serialJSON, err := ledger(ctx).GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if serialJSON == nil {
+		return fmt.Errorf("serial %s is not registered for medicine %s", serial, name)
+	}
+
+	var unit SerializedUnit
+	err = json.Unmarshal(serialJSON, &unit)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal serial JSON: %v", err)
+	}
+
+	// Reactivating a unit needs room under the lot quantity
+	if status == serialStatusActive && unit.Status != serialStatusActive {
+		err = checkSerialCapacity(ctx, medicine, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	unit.Status = status
+
+	return putSerial(ctx, key, &unit)
+}
+
+func (c *PharmaChaincode) GetSerials(ctx contractapi.TransactionContextInterface, name string) ([]*SerializedUnit, error) {
+	return queryComposite[SerializedUnit](ctx, serialObjectType, []string{name})
+}
+
+// WhoAmI reports the MSP ID the chaincode sees for the caller, which is what
+// every ownership and regulator check compares against.
+func (c *PharmaChaincode) WhoAmI(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := identity(ctx).GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get submitting organization: %v", err)
+	}
+
+	return mspID, nil
+}
+
+func (c *PharmaChaincode) SetAllowedRequesters(ctx contractapi.TransactionContextInterface, orgsJSON string) error {
+	if err := recordInvocation(ctx, "SetAllowedRequesters"); err != nil {
+		return err
+	}
+
+	// Request policy is set by the regulator
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != regulatorMSP {
+		return fmt.Errorf("only %s may set the allowed requesters", regulatorMSP)
+	}
+
+	var orgs []string
+	err = json.Unmarshal([]byte(orgsJSON), &orgs)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal organizations JSON: %v", err)
+	}
+	for _, org := range orgs {
+		if org == "" {
+			return fmt.Errorf("organization MSP ID must not be empty")
+		}
+	}
+
+	key, err := ledger(ctx).CreateCompositeKey(configObjectType, []string{allowedRequestersConfigKey})
+	if err != nil {
+		return fmt.Errorf("failed to create config key: %v", err)
+	}
+
+	orgListJSON, err := json.Marshal(orgs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal organizations to JSON: %v", err)
+	}
+
+	err = ledger(ctx).PutState(key, orgListJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return nil
+}
+
+func (c *PharmaChaincode) SetTrustedAttestationCerts(ctx contractapi.TransactionContextInterface, fingerprintsJSON string) error {
+	if err := recordInvocation(ctx, "SetTrustedAttestationCerts"); err != nil {
+		return err
+	}
+
+	// Attestation trust is managed by the regulator
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != regulatorMSP {
+		return fmt.Errorf("only %s may set the trusted attestation certificates", regulatorMSP)
+	}
+
+	var fingerprints []string
+	err = json.Unmarshal([]byte(fingerprintsJSON), &fingerprints)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal fingerprints JSON: %v", err)
+	}
+	for i, fingerprint := range fingerprints {
+		decoded, err := hex.DecodeString(fingerprint)
+		if err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("certificate fingerprint %q is not a hex SHA-256 digest", fingerprint)
+		}
+		fingerprints[i] = strings.ToLower(fingerprint)
+	}
+
+	key, err := ledger(ctx).CreateCompositeKey(configObjectType, []string{trustedAttestationCertsConfigKey})
+	if err != nil {
+		return fmt.Errorf("failed to create config key: %v", err)
+	}
+
+	fingerprintListJSON, err := json.Marshal(fingerprints)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fingerprints to JSON: %v", err)
+	}
+
+	err = ledger(ctx).PutState(key, fingerprintListJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return nil
+}
+
+func (c *PharmaChaincode) GetAuditLog(ctx contractapi.TransactionContextInterface, name string) ([]*AuditEntry, error) {
+	entries, err := queryComposite[AuditEntry](ctx, auditObjectType, []string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	// A nil slice marshals to null, but clients expect an array
+	if entries == nil {
+		entries = []*AuditEntry{}
+	}
+
+	// Sort the entries by timestamp, then by transaction ID
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Timestamp.Equal(entries[j].Timestamp) {
+			return entries[i].Timestamp.Before(entries[j].Timestamp)
+		}
+		return entries[i].TxID < entries[j].TxID
+	})
+
+	return entries, nil
+}
+
+func (c *PharmaChaincode) GetContractInfo(ctx contractapi.TransactionContextInterface) (*ContractInfo, error) {
+	// Methods promoted from contractapi.Contract are not transactions
+	inherited := make(map[string]bool)
+	contractType := reflect.TypeOf(&contractapi.Contract{})
+	for i := 0; i < contractType.NumMethod(); i++ {
+		inherited[contractType.Method(i).Name] = true
+	}
+
+	// reflect lists methods in lexicographic order, so the result is the same
+	// on every peer
+	info := &ContractInfo{
+		Version:       contractVersion,
+		SchemaVersion: schemaVersion,
+		Transactions:  []string{},
+	}
+	chaincodeType := reflect.TypeOf(c)
+	for i := 0; i < chaincodeType.NumMethod(); i++ {
+		name := chaincodeType.Method(i).Name
+		if !inherited[name] {
+			info.Transactions = append(info.Transactions, name)
+		}
+	}
+
+	return info, nil
+}
+
+func (c *PharmaChaincode) GetMetrics(ctx contractapi.TransactionContextInterface) (map[string]int, error) {
+	resultsIterator, err := ledger(ctx).GetStateByPartialCompositeKey(metricsObjectType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metrics by partial composite key: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	metrics := make(map[string]int)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over query results: %v", err)
+		}
+
+		_, attributes, err := ledger(ctx).SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split metrics key: %v", err)
+		}
+
+		var count int
+		err = json.Unmarshal(queryResponse.Value, &count)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal metrics count: %v", err)
+		}
+
+		// Keys written before per-transaction counters hold a running total,
+		// so summing covers both layouts
+		metrics[attributes[0]] += count
+	}
+
+	return metrics, nil
+}
+
+// CompactMetrics folds the per-transaction invocation keys into one total
+// key per method and deletes them, so the metrics keys stop growing with the
+// ledger. It returns how many keys were folded. Invocations committed while
+// it runs invalidate it under MVCC and it has to be resubmitted, but they are
+// never lost. Only a regulator may compact.
+func (c *PharmaChaincode) CompactMetrics(ctx contractapi.TransactionContextInterface) (int, error) {
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if caller != regulatorMSP {
+		return 0, fmt.Errorf("only %s may compact metrics", regulatorMSP)
+	}
+
+	resultsIterator, err := ledger(ctx).GetStateByPartialCompositeKey(metricsObjectType, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get metrics by partial composite key: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	totals := make(map[string]int)
+	folded := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to iterate over query results: %v", err)
+		}
+
+		_, attributes, err := ledger(ctx).SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to split metrics key: %v", err)
+		}
+
+		var count int
+		err = json.Unmarshal(queryResponse.Value, &count)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unmarshal metrics count: %v", err)
+		}
+		totals[attributes[0]] += count
+
+		// The total key of a method has no transaction ID and is rewritten below
+		if len(attributes) > 1 {
+			err = ledger(ctx).DelState(queryResponse.Key)
+			if err != nil {
+				return 0, fmt.Errorf("failed to delete metrics key: %v", err)
+			}
+			folded++
+		}
+	}
+
+	// Write the totals in a fixed order so the chaincode stays deterministic
+	methods := make([]string, 0, len(totals))
+	for method := range totals {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		key, err := ledger(ctx).CreateCompositeKey(metricsObjectType, []string{method})
+		if err != nil {
+			return 0, fmt.Errorf("failed to create metrics key: %v", err)
+		}
+
+		totalJSON, err := json.Marshal(totals[method])
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal metrics count: %v", err)
+		}
+
+		err = ledger(ctx).PutState(key, totalJSON)
+		if err != nil {
+			return 0, fmt.Errorf("failed to put metrics: %v", err)
+		}
+	}
+
+	return folded, nil
+}
+
+func readMedicine(ctx contractapi.TransactionContextInterface, name string) (*Medicine, error) {
+	medicine, err := readMedicineRecord(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if medicine.Deleted {
+		return nil, fmt.Errorf("%w: %s is archived", ErrMedicineNotFound, name)
+	}
+
+	return medicine, nil
+}
+
+// readMedicineRecord is readMedicine without hiding archived medicines
+func readMedicineRecord(ctx contractapi.TransactionContextInterface, name string) (*Medicine, error) {
+	key, err := resolveMedicineKey(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return readMedicineKey(ctx, key)
+}
+
+// readMedicineKey reads the medicine record stored under a world state key
+func readMedicineKey(ctx contractapi.TransactionContextInterface, key string) (*Medicine, error) {
+	medicineJSON, err := ledger(ctx).GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if medicineJSON == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMedicineNotFound, key)
+	}
+
+	var medicine Medicine
+	err = json.Unmarshal(medicineJSON, &medicine)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal medicine JSON: %v", err)
+	}
+
+	// A renamed medicine leaves a tombstone pointing at its new name
+	if medicine.RenamedTo != "" {
+		return nil, fmt.Errorf("%w: %s was renamed to %s", ErrMedicineNotFound, medicine.Name, medicine.RenamedTo)
+	}
+
+	return &medicine, nil
+}
+
+func getAllMedicines(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+	records, err := getMedicineRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rename tombstones are not medicines in their own right, and archived
+	// medicines are hidden until restored
+	var medicines []*Medicine
+	for _, medicine := range records {
+		if medicine.RenamedTo != "" || medicine.Deleted {
+			continue
+		}
+
+		medicines = append(medicines, medicine)
+	}
+
+	return medicines, nil
+}
+
+// getMedicineRecords returns every medicine record in the world state,
+// including rename tombstones and archived medicines.
+func getMedicineRecords(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+	// Get all medicines from the world state
+	resultsIterator, err := ledger(ctx).GetStateByRange("", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state by range: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	// Iterate through the results and unmarshal the medicines
+	var medicines []*Medicine
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over query results: %v", err)
+		}
+
+		var medicine Medicine
+		err = json.Unmarshal(queryResponse.Value, &medicine)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal medicine JSON: %v", err)
+		}
+
+		medicines = append(medicines, &medicine)
+	}
+
+	return medicines, nil
+}
+
+// Client values are JSON-encoded rather than interpolated into the query
+// text, so quotes or braces in them cannot change the selector.
+func buildSelector(field string, value string) (string, error) {
+	query := map[string]interface{}{
+		"selector": map[string]string{
+			field: value,
+		},
+	}
+
+	queryJSON, err := json.Marshal(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query: %v", err)
+	}
+
+	return string(queryJSON), nil
+}
+
+func queryMedicines(ctx contractapi.TransactionContextInterface, queryString string) ([]*Medicine, error) {
+	// Rich queries are only available when the peer uses CouchDB
+	resultsIterator, err := ledger(ctx).GetQueryResult(queryString)
+	if err != nil {
+		if isRichQueryUnsupported(err) {
+			return nil, fmt.Errorf("%w: %v", ErrRichQueryUnsupported, err)
+		}
+		return nil, fmt.Errorf("failed to get query result: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var medicines []*Medicine
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over query results: %v", err)
+		}
+
+		// Rich queries also see composite keys, which never hold medicines
+		if strings.HasPrefix(queryResponse.Key, compositeKeyNamespace) {
+			continue
+		}
+
+		var medicine Medicine
+		err = json.Unmarshal(queryResponse.Value, &medicine)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal medicine JSON: %v", err)
+		}
+
+		// Rename tombstones are not medicines in their own right, and
+		// archived medicines are hidden until restored
+		if medicine.RenamedTo != "" || medicine.Deleted {
+			continue
+		}
+
+		medicines = append(medicines, &medicine)
+	}
+
+	return medicines, nil
+}
+
+// queryMedicinesOrScan runs a rich query and, on peers without rich query
+// support, falls back to scanning every medicine with match instead. Other
+// query failures are returned rather than hidden by the fallback.
+func queryMedicinesOrScan(ctx contractapi.TransactionContextInterface, queryString string, match func(*Medicine) bool) ([]*Medicine, error) {
+	medicines, err := queryMedicines(ctx, queryString)
+	if !errors.Is(err, ErrRichQueryUnsupported) {
+		return medicines, err
+	}
+
+	candidates, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	medicines = nil
+	for _, medicine := range candidates {
+		if match(medicine) {
+			medicines = append(medicines, medicine)
+		}
+	}
+
+	return medicines, nil
+}
+
+// Fabric's LevelDB state database rejects rich queries with "ExecuteQuery not
+// supported for leveldb". The error reaches chaincode through the shim as text
+// only, so this is the one place that text is recognized.
+const richQueryUnsupportedMessage = "not supported for leveldb"
+
+func isRichQueryUnsupported(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), richQueryUnsupportedMessage)
+}
+
+// checkRequest applies the rules every request from the caller for quantity
+// units of a medicine must meet, and returns the caller's organization.
+func checkRequest(ctx contractapi.TransactionContextInterface, name string, quantity int) (string, error) {
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkNotQuarantined(medicine)
+	if err != nil {
+		return "", err
+	}
+
+	// Get the submitting organization
+	requester, err := requireCallerOrg(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	allowedOrgs, err := allowedRequesters(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Both values become request key attributes
+	err = validateMedicineName(name)
+	if err != nil {
+		return "", err
+	}
+	err = validateKeyPart("requester", requester)
+	if err != nil {
+		return "", err
+	}
+
+	// Check if the submitting organization is allowed to make requests
+	if !allowedOrgs[requester] {
+		return "", fmt.Errorf("organization '%s' is not allowed to make requests", requester)
+	}
+
+	// The requested quantity must be something the owner could supply
+	if quantity <= 0 {
+		return "", fmt.Errorf("requested quantity must be positive, got %d", quantity)
+	}
+	available, err := availableQuantity(ctx, medicine)
+	if err != nil {
+		return "", err
+	}
+	if quantity > available {
+		return "", fmt.Errorf("requested quantity %d exceeds available stock %d of medicine '%s'", quantity, available, name)
+	}
+
+	// Controlled substances additionally require a licensed identity
+	if medicine.ControlledSubstance {
+		err = identity(ctx).AssertAttributeValue("controlled-license", "true")
+		if err != nil {
+			return "", fmt.Errorf("identity is not licensed to request controlled medicine '%s': %v", name, err)
+		}
+	}
+
+	return requester, nil
+}
+
+func createRequest(ctx contractapi.TransactionContextInterface, name string, details string, detailsHash string, quantity int) (*MedicineRequest, string, error) {
+	requester, err := checkRequest(ctx, name, quantity)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Requests expire relative to the transaction time so every peer agrees
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// An organization may hold several requests for the same medicine, but
+	// not two identical unexpired ones
+	existingRequests, err := queryRequests(ctx, requester, name)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, previous := range existingRequests {
+		if previous.Details == details && previous.DetailsHash == detailsHash && previous.Quantity == quantity && !now.After(previous.ExpiresAt) {
+			return nil, "", fmt.Errorf("request for medicine '%s' already exists", name)
+		}
+	}
+
+	// Create a new request identified by the transaction that created it
+	request := MedicineRequest{
+		ID:           ledger(ctx).GetTxID(),
+		MedicineName: name,
+		Requester:    requester,
+		Details:      details,
+		DetailsHash:  detailsHash,
+		Quantity:     quantity,
+		ExpiresAt:    now.Add(requestTTL),
+	}
+
+	key, err := requestKey(ctx, &request)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Convert the request to JSON
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal request to JSON: %v", err)
+	}
+
+	// Save the request to the ledger
+	err = ledger(ctx).PutState(key, requestJSON)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to put state: %v", err)
+	}
+
+	err = writeAudit(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &request, key, nil
+}
+
+func allowedRequesters(ctx contractapi.TransactionContextInterface) (map[string]bool, error) {
+	key, err := ledger(ctx).CreateCompositeKey(configObjectType, []string{allowedRequestersConfigKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config key: %v", err)
+	}
+
+	orgsJSON, err := ledger(ctx).GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allowed requesters: %v", err)
+	}
+
+	orgs := defaultAllowedRequesters
+	if orgsJSON != nil {
+		orgs = nil
+		err = json.Unmarshal(orgsJSON, &orgs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal allowed requesters: %v", err)
+		}
+	}
+
+	allowed := make(map[string]bool)
+	for _, org := range orgs {
+		allowed[org] = true
+	}
+
+	return allowed, nil
+}
+
+func trustedAttestationCerts(ctx contractapi.TransactionContextInterface) (map[string]bool, error) {
+	key, err := ledger(ctx).CreateCompositeKey(configObjectType, []string{trustedAttestationCertsConfigKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config key: %v", err)
+	}
+
+	fingerprintsJSON, err := ledger(ctx).GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted attestation certificates: %v", err)
+	}
+
+	var fingerprints []string
+	if fingerprintsJSON != nil {
+		err = json.Unmarshal(fingerprintsJSON, &fingerprints)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal trusted attestation certificates: %v", err)
+		}
+	}
+
+	trusted := make(map[string]bool)
+	for _, fingerprint := range fingerprints {
+		trusted[fingerprint] = true
+	}
+
+	return trusted, nil
+}
+
+func activeRequests(ctx contractapi.TransactionContextInterface) ([]*MedicineRequest, error) {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	requests, err := queryRequests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only report requests that have not yet expired
+	var active []*MedicineRequest
+	for _, request := range requests {
+		if now.After(request.ExpiresAt) {
+			continue
+		}
+		active = append(active, request)
+	}
+
+	return active, nil
+}
+
+func requestsForMedicine(ctx contractapi.TransactionContextInterface, name string) ([]*MedicineRequest, error) {
+	// Request keys lead with the requester, so filter on the medicine here
+	requests, err := activeRequests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []*MedicineRequest
+	for _, request := range requests {
+		if request.MedicineName == name {
+			matching = append(matching, request)
+		}
+	}
+
+	// Sort the requests by requester, then by request ID
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].Requester != matching[j].Requester {
+			return matching[i].Requester < matching[j].Requester
+		}
+		return matching[i].ID < matching[j].ID
+	})
+
+	return matching, nil
+}
+
+// medicineLots returns the active records the name~id index maps a medicine
+// name to, or none if the name is unknown.
+func medicineLots(ctx contractapi.TransactionContextInterface, name string) ([]*Medicine, error) {
+	keys, err := medicineIDs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Records written before IDs existed are keyed by name
+	if len(keys) == 0 {
+		keys = []string{name}
+	}
+
+	lots := []*Medicine{}
+	for _, key := range keys {
+		medicine, err := readMedicineKey(ctx, key)
+		if errors.Is(err, ErrMedicineNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if medicine.Deleted {
+			continue
+		}
+		lots = append(lots, medicine)
+	}
+
+	return lots, nil
+}
+
+// availableQuantity is a lot's quantity including pending adjustments
+func availableQuantity(ctx contractapi.TransactionContextInterface, medicine *Medicine) (int, error) {
+	deltas, err := sumQuantityDeltas(ctx, medicine.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	return medicine.Quantity + deltas, nil
+}
+
+// lowStockMedicines returns the medicines whose available quantity is below
+// their minimum stock level, or also those at it if atLevel is set
+func lowStockMedicines(ctx contractapi.TransactionContextInterface, atLevel bool) ([]*Medicine, error) {
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var lowStock []*Medicine
+	for _, medicine := range medicines {
+		quantity, err := availableQuantity(ctx, medicine)
+		if err != nil {
+			return nil, err
+		}
+		if quantity < medicine.MinStockLevel || (atLevel && quantity == medicine.MinStockLevel) {
+			lowStock = append(lowStock, medicine)
+		}
+	}
+
+	// Sort the medicines by name in ascending order
+	sort.Slice(lowStock, func(i, j int) bool {
+		return medicineLess(lowStock[i], lowStock[j])
+	})
+
+	return lowStock, nil
+}
+
+func sumQuantityDeltas(ctx contractapi.TransactionContextInterface, name string) (int, error) {
+	deltas, err := queryComposite[int](ctx, quantityDeltaObjectType, []string{name})
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, delta := range deltas {
+		total += *delta
+	}
+
+	return total, nil
+}
+
+func deleteQuantityDeltas(ctx contractapi.TransactionContextInterface, name string) error {
+	resultsIterator, err := ledger(ctx).GetStateByPartialCompositeKey(quantityDeltaObjectType, []string{name})
+	if err != nil {
+		return fmt.Errorf("failed to get quantity deltas by partial composite key: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return fmt.Errorf("failed to iterate over query results: %v", err)
+		}
+
+		err = ledger(ctx).DelState(queryResponse.Key)
+		if err != nil {
+			return fmt.Errorf("failed to delete quantity delta: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func deleteSerials(ctx contractapi.TransactionContextInterface, name string) error {
+	units, err := queryComposite[SerializedUnit](ctx, serialObjectType, []string{name})
+	if err != nil {
+		return err
+	}
+
+	for _, unit := range units {
+		key, err := ledger(ctx).CreateCompositeKey(serialObjectType, []string{name, unit.Serial})
+		if err != nil {
+			return fmt.Errorf("failed to create serial key: %v", err)
+		}
+		err = ledger(ctx).DelState(key)
+		if err != nil {
+			return fmt.Errorf("failed to delete serial %s: %v", unit.Serial, err)
+		}
+	}
+
+	return nil
+}
+
+func queryRequests(ctx contractapi.TransactionContextInterface, attributes ...string) ([]*MedicineRequest, error) {
+	// Request keys are ordered requester, medicine name, request ID
+	return queryComposite[MedicineRequest](ctx, requestObjectType, attributes)
+}
+
+func queryComposite[T any](ctx contractapi.TransactionContextInterface, objectType string, keys []string) ([]*T, error) {
+	resultsIterator, err := ledger(ctx).GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s records by partial composite key: %v", objectType, err)
+	}
+	defer resultsIterator.Close()
+
+	var records []*T
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate over query results: %v", err)
+		}
+
+		var record T
+		err = json.Unmarshal(queryResponse.Value, &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s record: %v", objectType, err)
+		}
+
+		records = append(records, &record)
+	}
+
+	return records, nil
+}
+
+func requestKey(ctx contractapi.TransactionContextInterface, request *MedicineRequest) (string, error) {
+	key, err := ledger(ctx).CreateCompositeKey(requestObjectType, []string{request.Requester, request.MedicineName, request.ID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create request key: %v", err)
+	}
+
+	return key, nil
+}
+
+func putSerial(ctx contractapi.TransactionContextInterface, key string, unit *SerializedUnit) error {
+	serialJSON, err := json.Marshal(unit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal serial to JSON: %v", err)
+	}
+
+	err = ledger(ctx).PutState(key, serialJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put state: %v", err)
+	}
+
+	return writeAudit(ctx, unit.MedicineName)
+}
+
+// checkSerialCapacity fails if the medicine's active serials, plus the given
+// number about to be activated, would exceed its quantity.
+func checkSerialCapacity(ctx contractapi.TransactionContextInterface, medicine *Medicine, adding int) error {
+	quantity, err := availableQuantity(ctx, medicine)
+	if err != nil {
+		return err
+	}
+
+	return checkSerialLimit(ctx, medicine, adding, quantity)
+}
+
+// checkSerialLimit is checkSerialCapacity against an explicit quantity, for
+// callers whose pending deltas are being discarded in the same transaction
+func checkSerialLimit(ctx contractapi.TransactionContextInterface, medicine *Medicine, adding int, quantity int) error {
+	units, err := queryComposite[SerializedUnit](ctx, serialObjectType, []string{medicine.Name})
+	if err != nil {
+		return err
+	}
+
+	active := adding
+	for _, unit := range units {
+		if unit.Status == serialStatusActive {
+			active++
+		}
+	}
+
+	if active > quantity {
+		return fmt.Errorf("medicine %s would have %d active serials but a quantity of only %d", medicine.Name, active, quantity)
+	}
+
+	return nil
+}
+
+// moveSerials re-keys every serial registered under oldName to the renamed
+// medicine, checking that its active units still fit the renamed quantity.
+func moveSerials(ctx contractapi.TransactionContextInterface, oldName string, renamed *Medicine) error {
+	units, err := queryComposite[SerializedUnit](ctx, serialObjectType, []string{oldName})
+	if err != nil {
+		return err
+	}
+
+	active := 0
+	for _, unit := range units {
+		if unit.Status == serialStatusActive {
+			active++
+		}
+	}
+	if active > renamed.Quantity {
+		return fmt.Errorf("medicine %s would have %d active serials but a quantity of only %d", renamed.Name, active, renamed.Quantity)
+	}
+
+	for _, unit := range units {
+		oldKey, err := ledger(ctx).CreateCompositeKey(serialObjectType, []string{oldName, unit.Serial})
+		if err != nil {
+			return fmt.Errorf("failed to create serial key: %v", err)
+		}
+		err = ledger(ctx).DelState(oldKey)
+		if err != nil {
+			return fmt.Errorf("failed to delete serial %s: %v", unit.Serial, err)
+		}
+
+		newKey, err := ledger(ctx).CreateCompositeKey(serialObjectType, []string{renamed.Name, unit.Serial})
+		if err != nil {
+			return fmt.Errorf("failed to create serial key: %v", err)
+		}
+		unit.MedicineName = renamed.Name
+		err = putSerial(ctx, newKey, unit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func transferAllMedicines(ctx contractapi.TransactionContextInterface, owner string, newOwner string) (int, error) {
+	if newOwner == "" || newOwner == owner {
+		return 0, fmt.Errorf("new owner must be a different organization than %s", owner)
+	}
+
+	medicines, err := getAllMedicines(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	transfer := bulkTransfer{
+		From:  owner,
+		To:    newOwner,
+		Names: []string{},
+	}
+	for _, medicine := range medicines {
+		if medicine.Owner != owner {
+			continue
+		}
+
+		err = checkNoPendingTransfer(medicine)
+		if err != nil {
+			return 0, fmt.Errorf("failed to transfer medicine %s: %v", medicine.Name, err)
+		}
+
+		err = checkNotQuarantined(medicine)
+		if err != nil {
+			return 0, fmt.Errorf("failed to transfer medicine %s: %v", medicine.Name, err)
+		}
+
+		quantity, err := availableQuantity(ctx, medicine)
+		if err != nil {
+			return 0, err
+		}
+		err = checkControlledTransfer(medicine, quantity)
+		if err != nil {
+			return 0, fmt.Errorf("failed to transfer medicine %s: %v", medicine.Name, err)
+		}
+
+		nearExpiry, err := checkTransferExpiry(ctx, medicine)
+		if err != nil {
+			return 0, fmt.Errorf("failed to transfer medicine %s: %v", medicine.Name, err)
+		}
+
+		err = transferOwnership(ctx, medicine, newOwner)
+		if err != nil {
+			return 0, fmt.Errorf("failed to transfer medicine %s: %v", medicine.Name, err)
+		}
+		transfer.Names = append(transfer.Names, medicine.Name)
+		if nearExpiry {
+			transfer.NearExpiry = append(transfer.NearExpiry, medicine.Name)
+		}
+	}
+
+	err = emitEvent(ctx, "MedicinesTransferred", transfer)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(transfer.Names), nil
+}
+
+// archiveMedicine soft-deletes a medicine on behalf of caller and returns
+// the record as it was before archiving.
+func archiveMedicine(ctx contractapi.TransactionContextInterface, name string, caller string) (*Medicine, error) {
+	// Check if medicine exists
+	medicine, err := readMedicine(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the owning organization or a regulator may delete the medicine
+	if caller != medicine.Owner && caller != regulatorMSP {
+		return nil, fmt.Errorf("only the owner %s may delete medicine %s", medicine.Owner, name)
+	}
+
+	err = checkNoPendingTransfer(medicine)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to delete a medicine that other organizations are still waiting on
+	requests, err := requestsForMedicine(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) > 0 {
+		return nil, fmt.Errorf("medicine %s still has %d outstanding requests", name, len(requests))
+	}
+
+	snapshot := *medicine
+	medicine.Deleted = true
+
+	err = putMedicine(ctx, medicine)
+	if err != nil {
+		return nil, err
+	}
+
+	// Archived medicines are not listed under their owner
+	err = deleteOwnerIndex(ctx, medicine)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+func transferOwnership(ctx contractapi.TransactionContextInterface, medicine *Medicine, newOwner string) error {
+	reassignOwner(medicine, newOwner)
+
+	return putMedicine(ctx, medicine)
+}
+
+func reassignOwner(medicine *Medicine, newOwner string) {
+	// The new owner has not confirmed receipt yet
+	medicine.Owner = newOwner
+	medicine.PendingOwner = ""
+	medicine.ReceiptAcknowledged = false
+	medicine.ReceivedAt = time.Time{}
+
+	// Donation details describe only the transfer that recorded them
+	medicine.TransferType = ""
+	medicine.DonationProgram = ""
+	medicine.DonatedAt = time.Time{}
+
+	// The contact belongs to the previous owner
+	medicine.OwnerContact = ""
+}
+
+// returnLotName names the lot opened for stock returned to owner when owner
+// no longer holds the lot the stock was split from
+func returnLotName(name string, owner string) string {
+	return name + returnLotSeparator + owner
+}
+
+// returnTarget finds the holding of toOwner that returned stock is added to
+// through the owner~name index: the lot the stock was split from, then the
+// lot earlier returns opened. It returns nil if toOwner holds neither.
+func returnTarget(ctx contractapi.TransactionContextInterface, source *Medicine, toOwner string) (*Medicine, error) {
+	for _, name := range []string{source.SplitFrom, returnLotName(source.Name, toOwner)} {
+		if name == "" {
+			continue
+		}
+
+		indexKey, err := ledger(ctx).CreateCompositeKey(ownerIndexObjectType, []string{toOwner, name})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create owner index key: %v", err)
+		}
+		entry, err := ledger(ctx).GetState(indexKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read owner index: %v", err)
+		}
+		if entry == nil {
+			continue
+		}
+
+		// The index entry is stale if the lot was renamed or purged since
+		target, err := readMedicineRecord(ctx, name)
+		if errors.Is(err, ErrMedicineNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if target.Owner == toOwner {
+			return target, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func checkNoPendingTransfer(medicine *Medicine) error {
+	if medicine.PendingOwner != "" {
+		return fmt.Errorf("medicine %s has a pending transfer to %s", medicine.Name, medicine.PendingOwner)
+	}
+
+	return nil
+}
+
+func checkControlledTransfer(medicine *Medicine, quantity int) error {
+	if medicine.ControlledSubstance && quantity > maxControlledTransfer {
+		return fmt.Errorf("cannot transfer %d of controlled substance %s: the limit per transfer is %d", quantity, medicine.Name, maxControlledTransfer)
+	}
+
+	return nil
+}
+
+func checkQualityAssurance(ctx contractapi.TransactionContextInterface) error {
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+	if caller != qualityAssuranceMSP && caller != regulatorMSP {
+		return fmt.Errorf("only %s or %s may change the quarantine state of a medicine", qualityAssuranceMSP, regulatorMSP)
+	}
+
+	return nil
+}
+
+// checkTransferExpiry refuses to move expired stock and reports whether the
+// medicine expires within expiryGracePeriod.
+func checkTransferExpiry(ctx contractapi.TransactionContextInterface, medicine *Medicine) (bool, error) {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if medicine.ExpiryDate.Before(now) {
+		return false, fmt.Errorf("medicine %s expired on %s and cannot be transferred", medicine.Name, medicine.ExpiryDate.Format(time.RFC3339))
+	}
+
+	return medicine.ExpiryDate.Before(now.Add(expiryGracePeriod)), nil
+}
+
+func checkNotQuarantined(medicine *Medicine) error {
+	if medicine.Quarantined {
+		return fmt.Errorf("medicine %s is quarantined: %s", medicine.Name, medicine.QuarantineReason)
+	}
+
+	return nil
+}
+
+func newMedicine(ctx contractapi.TransactionContextInterface, input medicineInput, owner string) (*Medicine, error) {
+	err := validateMedicineName(input.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	unit := input.Unit
+	if unit == "" {
+		unit = defaultUnit
+	}
+
+	// Parse dates
+	manufactureTime, err := parseDate("manufacture date", input.ManufactureDate)
+	if err != nil {
+		return nil, err
+	}
+
+	expiryTime, err := parseDate("expiry date", input.ExpiryDate)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new Medicine instance
+	medicine := &Medicine{
+		Name:                input.Name,
+		Quantity:            input.Quantity,
+		ManufactureDate:     manufactureTime,
+		ExpiryDate:          expiryTime,
+		Owner:               owner,
+		Category:            input.Category,
+		DosageForm:          input.DosageForm,
+		ControlledSubstance: input.ControlledSubstance,
+		Unit:                unit,
+		MinStockLevel:       input.MinStockLevel,
+		Price:               input.Price,
+		Currency:            input.Currency,
+	}
+
+	err = prepareNewMedicine(ctx, medicine)
+	if err != nil {
+		return nil, err
+	}
+
+	return medicine, nil
+}
+
+// prepareNewMedicine validates a medicine about to be created, checks that
+// its name is free and stamps its creation time.
+func prepareNewMedicine(ctx contractapi.TransactionContextInterface, medicine *Medicine) error {
+	err := validateNewMedicineName(medicine.Name)
+	if err != nil {
+		return err
+	}
+
+	err = validateMedicine(medicine)
+	if err != nil {
+		return err
+	}
+
+	// Check if medicine with the same name already exists
+	existingMedicine, err := getMedicineState(ctx, medicine.Name)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existingMedicine != nil {
+		return fmt.Errorf("%w: %s", ErrMedicineExists, medicine.Name)
+	}
+
+	medicine.ID = medicineID(ctx, medicine.Name)
+
+	// Dates decoded from client JSON keep the client's offset
+	medicine.ManufactureDate = medicine.ManufactureDate.UTC()
+	medicine.ExpiryDate = medicine.ExpiryDate.UTC()
+
+	medicine.CreatedAt, err = txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateMedicine holds the rules every medicine record must satisfy,
+// whichever transaction builds it.
+func validateMedicine(medicine *Medicine) error {
+	err := validateMedicineName(medicine.Name)
+	if err != nil {
+		return err
+	}
+
+	if medicine.Quantity <= 0 {
+		return fmt.Errorf("quantity must be positive, got %d", medicine.Quantity)
+	}
+
+	if medicine.ManufactureDate.IsZero() {
+		return fmt.Errorf("manufacture date is required")
+	}
+	if medicine.ExpiryDate.IsZero() {
+		return fmt.Errorf("expiry date is required")
+	}
+	if !medicine.ManufactureDate.Before(medicine.ExpiryDate) {
+		return fmt.Errorf("manufacture date %s must be before expiry date %s", medicine.ManufactureDate.Format(time.RFC3339), medicine.ExpiryDate.Format(time.RFC3339))
+	}
+
+	if !allowedUnits[medicine.Unit] {
+		return fmt.Errorf("unit %q is not one of the supported units", medicine.Unit)
+	}
+
+	if medicine.MinStockLevel < 0 {
+		return fmt.Errorf("minimum stock level must not be negative, got %d", medicine.MinStockLevel)
+	}
+
+	if medicine.Price < 0 {
+		return fmt.Errorf("price must not be negative, got %v", medicine.Price)
+	}
+	if medicine.Price > 0 || medicine.Currency != "" {
+		err = validateCurrency(medicine.Currency)
+		if err != nil {
+			return err
+		}
+	}
+
+	for key, value := range medicine.Attributes {
+		err = validateAttribute(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseAttestationCert(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("signing certificate is not PEM encoded")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing certificate: %v", err)
+	}
+
+	return cert, nil
 }
 
-type MedicineHistory struct {
-	TxID      string    `json:"txId"`
-	Value     Medicine  `json:"value"`
-	Timestamp time.Time `json:"timestamp"`
+// certFingerprint is the hex SHA-256 of the certificate's DER encoding, the
+// form the attestation trust list is kept in
+func certFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(hash[:])
 }
 
-type MedicineRequest struct {
-	MedicineName string `json:"medicineName"`
-	Requester    string `json:"requester"`
-	Details      string `json:"details"`
+func verifyAttestation(cert *x509.Certificate, payload []byte, signature []byte) error {
+	publicKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("signing certificate does not hold an ECDSA key")
+	}
+
+	hash := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(publicKey, hash[:], signature) {
+		return fmt.Errorf("attestation signature does not match the medicine")
+	}
+
+	return nil
 }
 
-func (c *PharmaChaincode) AddMedicine(ctx contractapi.TransactionContextInterface, name string, quantity int, manufactureDate string, expiryDate string) error {
-	// Check if medicine with the same name already exists
-	existingMedicine, err := ctx.GetStub().GetState(name)
-	if err != nil {
-		return fmt.Errorf("failed to read from world state: %v", err)
+func validateAttribute(key string, value string) error {
+	if key == "" {
+		return fmt.Errorf("attribute key must not be empty")
 	}
-	if existingMedicine != nil {
-		return fmt.Errorf("medicine with name %s already exists", name)
+	if len(key) > maxAttributeKeyLength {
+		return fmt.Errorf("attribute key %q exceeds %d bytes", key, maxAttributeKeyLength)
+	}
+	if len(value) > maxAttributeValueLength {
+		return fmt.Errorf("value of attribute %q exceeds %d bytes", key, maxAttributeValueLength)
 	}
 
-	// Parse dates
-	manufactureTime, err := time.Parse(time.RFC3339, manufactureDate)
-	if err != nil {
-		return fmt.Errorf("failed to parse manufacture date: %v", err)
+	return nil
+}
+
+// validateCurrency accepts three-letter upper-case ISO 4217 style codes
+func validateCurrency(currency string) error {
+	if len(currency) != 3 {
+		return fmt.Errorf("currency %q must be a three-letter code such as USD", currency)
+	}
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return fmt.Errorf("currency %q must be a three-letter code such as USD", currency)
+		}
 	}
 
-	expiryTime, err := time.Parse(time.RFC3339, expiryDate)
-	if err != nil {
-		return fmt.Errorf("failed to parse expiry date: %v", err)
+	return nil
+}
+
+func putMedicine(ctx contractapi.TransactionContextInterface, medicine *Medicine) error {
+	// Move the owner index entry if the owner changed
+	previous, err := readMedicine(ctx, medicine.Name)
+	if err != nil && !errors.Is(err, ErrMedicineNotFound) {
+		return err
 	}
+	if previous == nil || previous.Owner != medicine.Owner {
+		if previous != nil {
+			err = deleteOwnerIndex(ctx, previous)
+			if err != nil {
+				return err
+			}
+		}
 
-	// Get the submitting organization
-	owner, err := ctx.GetClientIdentity().GetMSPID()
-	if err != nil {
-		return fmt.Errorf("failed to get submitting organization: %v", err)
+		err = putOwnerIndex(ctx, medicine)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Create a new Medicine instance
-	medicine := Medicine{
-		Name:           name,
-		Quantity:       quantity,
-		ManufactureDate: manufactureTime,
-		ExpiryDate:     expiryTime,
-		Owner:          owner,
+	if previous == nil && medicine.ID != "" {
+		err = putNameIndex(ctx, medicine)
+		if err != nil {
+			return err
+		}
+	}
+
+	medicine.LastModifiedAt, err = txTimestamp(ctx)
+	if err != nil {
+		return err
 	}
 
 	// Convert the Medicine instance to JSON
@@ -79,159 +5153,471 @@ func (c *PharmaChaincode) AddMedicine(ctx contractapi.TransactionContextInterfac
 	}
 
 	// Put the Medicine instance to the world state
-	err = ctx.GetStub().PutState(name, medicineJSON)
+	err = ledger(ctx).PutState(medicineKey(medicine), medicineJSON)
 	if err != nil {
 		return fmt.Errorf("failed to put state: %v", err)
 	}
 
-	return nil
+	return writeAudit(ctx, medicine.Name)
 }
 
-func (c *PharmaChaincode) DeleteMedicine(ctx contractapi.TransactionContextInterface, name string) error {
-	// Check if medicine exists
-	existingMedicine, err := ctx.GetStub().GetState(name)
+func deleteMedicine(ctx contractapi.TransactionContextInterface, medicine *Medicine) error {
+	err := deleteOwnerIndex(ctx, medicine)
 	if err != nil {
-		return fmt.Errorf("failed to read from world state: %v", err)
+		return err
 	}
-	if existingMedicine == nil {
-		return fmt.Errorf("medicine with name %s does not exist", name)
+
+	if medicine.ID != "" {
+		err = deleteNameIndex(ctx, medicine)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Delete the medicine from the world state
-	err = ctx.GetStub().DelState(name)
+	err = ledger(ctx).DelState(medicineKey(medicine))
 	if err != nil {
 		return fmt.Errorf("failed to delete state: %v", err)
 	}
 
+	// A later lot under the same name must not inherit the adjustments or
+	// the serialized units
+	err = deleteQuantityDeltas(ctx, medicine.Name)
+	if err != nil {
+		return err
+	}
+	err = deleteSerials(ctx, medicine.Name)
+	if err != nil {
+		return err
+	}
+
+	return writeAudit(ctx, medicine.Name)
+}
+
+// writeAudit records who changed a medicine in this transaction. The action
+// is the invoked transaction function, so every path that writes a medicine
+// is covered without each caller naming itself.
+func writeAudit(ctx contractapi.TransactionContextInterface, medicineName string) error {
+	return writeAuditEntry(ctx, medicineName, "")
+}
+
+// writeAuditEntry writes the audit entry for this transaction with an
+// optional reason, replacing any entry already written for the medicine.
+func writeAuditEntry(ctx contractapi.TransactionContextInterface, medicineName string, reason string) error {
+	actor, err := requireCallerOrg(ctx)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Functions of a named contract are invoked as "contract:function"
+	action, _ := ledger(ctx).GetFunctionAndParameters()
+	if i := strings.LastIndex(action, ":"); i >= 0 {
+		action = action[i+1:]
+	}
+
+	entry := AuditEntry{
+		TxID:         ledger(ctx).GetTxID(),
+		Action:       action,
+		MedicineName: medicineName,
+		Actor:        actor,
+		Timestamp:    timestamp,
+		Reason:       reason,
+	}
+
+	key, err := ledger(ctx).CreateCompositeKey(auditObjectType, []string{medicineName, entry.TxID})
+	if err != nil {
+		return fmt.Errorf("failed to create audit key: %v", err)
+	}
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry to JSON: %v", err)
+	}
+
+	err = ledger(ctx).PutState(key, entryJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put audit entry: %v", err)
+	}
+
 	return nil
 }
 
-func (c *PharmaChaincode) ListMedicines(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
-	// Get all medicines from the world state
-	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+// The owner~name index lets owner lookups use a partial composite key query
+// instead of scanning every medicine when CouchDB is not available.
+func putOwnerIndex(ctx contractapi.TransactionContextInterface, medicine *Medicine) error {
+	indexKey, err := ledger(ctx).CreateCompositeKey(ownerIndexObjectType, []string{medicine.Owner, medicine.Name})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get state by range: %v", err)
+		return fmt.Errorf("failed to create owner index key: %v", err)
+	}
+
+	// Index entries only need a key, but an empty value would delete it
+	err = ledger(ctx).PutState(indexKey, []byte{0x00})
+	if err != nil {
+		return fmt.Errorf("failed to put owner index: %v", err)
+	}
+
+	return nil
+}
+
+func deleteOwnerIndex(ctx contractapi.TransactionContextInterface, medicine *Medicine) error {
+	indexKey, err := ledger(ctx).CreateCompositeKey(ownerIndexObjectType, []string{medicine.Owner, medicine.Name})
+	if err != nil {
+		return fmt.Errorf("failed to create owner index key: %v", err)
+	}
+
+	err = ledger(ctx).DelState(indexKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete owner index: %v", err)
+	}
+
+	return nil
+}
+
+// medicineID derives the immutable key of a new record. The transaction ID
+// is the same on every endorsing peer, so all of them derive the same ID.
+func medicineID(ctx contractapi.TransactionContextInterface, name string) string {
+	// Names cannot contain a null character, so the joined input is unambiguous
+	hash := sha256.Sum256([]byte(name + "\x00" + ledger(ctx).GetTxID()))
+	return hex.EncodeToString(hash[:])
+}
+
+// medicineKey is the world state key of a record. Records written before IDs
+// existed are still keyed by name.
+func medicineKey(medicine *Medicine) string {
+	if medicine.ID != "" {
+		return medicine.ID
+	}
+
+	return medicine.Name
+}
+
+// medicineIDs returns the IDs the name~id index maps a medicine name to
+func medicineIDs(ctx contractapi.TransactionContextInterface, name string) ([]string, error) {
+	return indexedIDs(ctx, nameIndexObjectType, name)
+}
+
+// medicineHistoryKeys returns every world state key a medicine name has been
+// stored under: the IDs it has mapped to, including purged ones, and the name
+// itself for records written before IDs existed.
+func medicineHistoryKeys(ctx contractapi.TransactionContextInterface, name string) ([]string, error) {
+	pointers, err := indexedIDs(ctx, nameHistoryObjectType, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Records indexed before history pointers existed only have an index entry
+	live, err := medicineIDs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{name}
+	seen := map[string]bool{name: true}
+	for _, id := range append(pointers, live...) {
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, id)
+		}
+	}
+
+	return keys, nil
+}
+
+func indexedIDs(ctx contractapi.TransactionContextInterface, objectType string, name string) ([]string, error) {
+	resultsIterator, err := ledger(ctx).GetStateByPartialCompositeKey(objectType, []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s index by partial composite key: %v", objectType, err)
 	}
 	defer resultsIterator.Close()
 
-	// Iterate through the results and unmarshal the medicines
-	var medicines []*Medicine
+	var ids []string
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
 			return nil, fmt.Errorf("failed to iterate over query results: %v", err)
 		}
 
-		var medicine Medicine
-		err = json.Unmarshal(queryResponse.Value, &medicine)
+		_, attributes, err := ledger(ctx).SplitCompositeKey(queryResponse.Key)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal medicine JSON: %v", err)
+			return nil, fmt.Errorf("failed to split name index key: %v", err)
 		}
+		ids = append(ids, attributes[1])
+	}
 
-		medicines = append(medicines, &medicine)
+	return ids, nil
+}
+
+// resolveMedicineKey returns the world state key of the record named name
+func resolveMedicineKey(ctx contractapi.TransactionContextInterface, name string) (string, error) {
+	ids, err := medicineIDs(ctx, name)
+	if err != nil {
+		return "", err
 	}
 
-	// Sort the medicines by name in ascending order
-	sort.Slice(medicines, func(i, j int) bool {
-		return medicines[i].Name < medicines[j].Name
-	})
+	switch len(ids) {
+	case 0:
+		// Not indexed, so either unknown or written before IDs existed
+		return name, nil
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("medicine name %s maps to %d IDs", name, len(ids))
+	}
+}
 
-	return medicines, nil
+// getMedicineState returns the stored bytes of the record named name, or nil
+// if there is none
+func getMedicineState(ctx contractapi.TransactionContextInterface, name string) ([]byte, error) {
+	key, err := resolveMedicineKey(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return ledger(ctx).GetState(key)
 }
 
-func (c *PharmaChaincode) ShowMedicineHistory(ctx contractapi.TransactionContextInterface, name string) ([]*MedicineHistory, error) {
-	// Get the history of the medicine
-	resultsIterator, err := ctx.GetStub().GetHistoryForKey(name)
+func putNameIndex(ctx contractapi.TransactionContextInterface, medicine *Medicine) error {
+	indexKey, err := ledger(ctx).CreateCompositeKey(nameIndexObjectType, []string{medicine.Name, medicine.ID})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get history for key %s: %v", name, err)
+		return fmt.Errorf("failed to create name index key: %v", err)
 	}
-	defer resultsIterator.Close()
 
-	// Iterate through the results and unmarshal the history
-	var medicineHistory []*MedicineHistory
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return nil, fmt.Errorf("failed to iterate over history query results: %v", err)
-		}
+	// Index entries only need a key, but an empty value would delete it
+	err = ledger(ctx).PutState(indexKey, []byte{0x00})
+	if err != nil {
+		return fmt.Errorf("failed to put name index: %v", err)
+	}
 
-		var txValue Medicine
-		err = json.Unmarshal(queryResponse.Value, &txValue)
+	// The history pointer is never deleted, so the history of a purged
+	// medicine stays reachable by its name
+	pointerKey, err := ledger(ctx).CreateCompositeKey(nameHistoryObjectType, []string{medicine.Name, medicine.ID})
+	if err != nil {
+		return fmt.Errorf("failed to create name history key: %v", err)
+	}
+
+	err = ledger(ctx).PutState(pointerKey, []byte{0x00})
+	if err != nil {
+		return fmt.Errorf("failed to put name history: %v", err)
+	}
+
+	return nil
+}
+
+func deleteNameIndex(ctx contractapi.TransactionContextInterface, medicine *Medicine) error {
+	indexKey, err := ledger(ctx).CreateCompositeKey(nameIndexObjectType, []string{medicine.Name, medicine.ID})
+	if err != nil {
+		return fmt.Errorf("failed to create name index key: %v", err)
+	}
+
+	err = ledger(ctx).DelState(indexKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete name index: %v", err)
+	}
+
+	return nil
+}
+
+// claimIdempotencyKey records the idempotency key passed in the transient
+// field, if any, and reports whether the caller already used it within
+// idempotencyTTL. Reusing a key for a different method is an error. Without
+// a key every call is applied.
+func claimIdempotencyKey(ctx contractapi.TransactionContextInterface, method string) (bool, error) {
+	transient, err := ledger(ctx).GetTransient()
+	if err != nil {
+		return false, fmt.Errorf("failed to get transient data: %v", err)
+	}
+	idempotencyKey := string(transient[idempotencyTransientKey])
+	if idempotencyKey == "" {
+		return false, nil
+	}
+
+	err = validateKeyPart("idempotency key", idempotencyKey)
+	if err != nil {
+		return false, err
+	}
+
+	caller, err := requireCallerOrg(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// Keys are scoped to the caller so organizations cannot collide
+	key, err := ledger(ctx).CreateCompositeKey(idempotencyObjectType, []string{caller, idempotencyKey})
+	if err != nil {
+		return false, fmt.Errorf("failed to create idempotency key: %v", err)
+	}
+
+	recordJSON, err := ledger(ctx).GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if recordJSON != nil {
+		var previous idempotencyRecord
+		err = json.Unmarshal(recordJSON, &previous)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal medicine JSON from history: %v", err)
+			return false, fmt.Errorf("failed to unmarshal idempotency record: %v", err)
 		}
 
-		historyEntry := &MedicineHistory{
-			TxID:      queryResponse.TxId,
-			Value:     txValue,
-			Timestamp: queryResponse.Timestamp,
+		if !now.After(previous.ExpiresAt) {
+			if previous.Method != method {
+				return false, fmt.Errorf("idempotency key %s was already used for %s", idempotencyKey, previous.Method)
+			}
+			return true, nil
 		}
+	}
+
+	record := idempotencyRecord{
+		Caller:    caller,
+		Key:       idempotencyKey,
+		Method:    method,
+		TxID:      ledger(ctx).GetTxID(),
+		ExpiresAt: now.Add(idempotencyTTL),
+	}
+	recordJSON, err = json.Marshal(record)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal idempotency record: %v", err)
+	}
 
-		medicineHistory = append(medicineHistory, historyEntry)
+	err = ledger(ctx).PutState(key, recordJSON)
+	if err != nil {
+		return false, fmt.Errorf("failed to put state: %v", err)
 	}
 
-	return medicineHistory, nil
+	return false, nil
 }
 
-func (c *PharmaChaincode) RequestMedicine(ctx contractapi.TransactionContextInterface, name string, details string) error {
-	// Check if medicine exists
-	existingMedicine, err := ctx.GetStub().GetState(name)
+// requireCallerOrg returns the caller's MSP ID, refusing an empty one so a
+// misconfigured identity can never become a record owner.
+func requireCallerOrg(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := identity(ctx).GetMSPID()
 	if err != nil {
-		return fmt.Errorf("failed to read from world state: %v", err)
+		return "", fmt.Errorf("failed to get submitting organization: %v", err)
 	}
-	if existingMedicine == nil {
-		return fmt.Errorf("medicine with name %s does not exist", name)
+	if mspID == "" {
+		return "", fmt.Errorf("could not determine caller organization")
 	}
 
-	// Get the submitting organization
-	requester, err := ctx.GetClientIdentity().GetMSPID()
+	return mspID, nil
+}
+
+func txTimestamp(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	timestamp, err := ledger(ctx).GetTxTimestamp()
 	if err != nil {
-		return fmt.Errorf("failed to get submitting organization: %v", err)
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %v", err)
 	}
 
-	// Define the allowed organizations for requests (adjust as needed)
-	allowedOrgs := map[string]bool{
-		"ProducerMSP": true,
-		"SupplierMSP": true,
-		// Add other allowed organizations
+	return timestamp.AsTime(), nil
+}
+
+// Fabric delivers only the last event set by a transaction, so callers that
+// touch several records emit one event describing all of them.
+func emitEvent(ctx contractapi.TransactionContextInterface, eventName string, payload interface{}) error {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %v", eventName, err)
 	}
 
-	// Check if the submitting organization is allowed to make requests
-	if !allowedOrgs[requester] {
-		return fmt.Errorf("organization '%s' is not allowed to make requests", requester)
+	err = ledger(ctx).SetEvent(eventName, payloadJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set %s event: %v", eventName, err)
 	}
 
-	// Create a unique key for the request using the medicine name
-	requestKey := fmt.Sprintf("request_%s_%s", requester, name)
+	return nil
+}
 
-	// Check if the request already exists
-	existingRequest, err := ctx.GetStub().GetState(requestKey)
+// Invocation counts are best-effort telemetry. A shared counter would be a
+// read-modify-write, so two concurrent transactions calling the same method
+// would conflict under MVCC validation and one of them would be invalidated
+// even if its real work did not clash. Instead every invocation writes its
+// own key, made unique by the transaction ID, and reads nothing; GetMetrics
+// adds them up and CompactMetrics folds them into one total per method.
+// Counts only cover committed transactions.
+func recordInvocation(ctx contractapi.TransactionContextInterface, method string) error {
+	key, err := ledger(ctx).CreateCompositeKey(metricsObjectType, []string{method, ledger(ctx).GetTxID()})
 	if err != nil {
-		return fmt.Errorf("failed to read request: %v", err)
+		return fmt.Errorf("failed to create metrics key: %v", err)
 	}
 
-	if existingRequest != nil {
-		return fmt.Errorf("request for medicine '%s' already exists", name)
+	countJSON, err := json.Marshal(1)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metrics count: %v", err)
 	}
 
-	// Create a new request
-	request := MedicineRequest{
-		MedicineName: name,
-		Requester:    requester,
-		Details:      details,
+	err = ledger(ctx).PutState(key, countJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put metrics: %v", err)
 	}
 
-	// Convert the request to JSON
-	requestJSON, err := json.Marshal(request)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request to JSON: %v", err)
+	return nil
+}
+
+// Query results must come back in the same order on every endorsing peer,
+// otherwise their responses differ and endorsement fails. medicineLess gives
+// a total order over medicines so ties never depend on sort internals.
+func medicineLess(a *Medicine, b *Medicine) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if a.Owner != b.Owner {
+		return a.Owner < b.Owner
 	}
+	return a.ExpiryDate.Before(b.ExpiryDate)
+}
 
-	// Save the request to the ledger
-	err = ctx.GetStub().PutState(requestKey, requestJSON)
+func validateMedicineName(name string) error {
+	if name == "" {
+		return fmt.Errorf("medicine name must not be empty")
+	}
+	if utf8.RuneCountInString(name) > maxMedicineNameLength {
+		return fmt.Errorf("medicine name must be at most %d characters", maxMedicineNameLength)
+	}
+
+	return validateKeyPart("medicine name", name)
+}
+
+// validateNewMedicineName also keeps names that are not yet taken clear of
+// the names ReturnMedicine gives the lots it opens
+func validateNewMedicineName(name string) error {
+	err := validateMedicineName(name)
 	if err != nil {
-		return fmt.Errorf("failed to put state: %v", err)
+		return err
+	}
+	if strings.Contains(name, returnLotSeparator) {
+		return fmt.Errorf("medicine name %q must not contain %q", name, returnLotSeparator)
+	}
+
+	return nil
+}
+
+// Values used as composite key attributes must not contain the delimiters
+// Fabric reserves for composite keys and range queries.
+func validateKeyPart(field string, value string) error {
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("%s must be valid UTF-8", field)
+	}
+	if strings.ContainsRune(value, 0) || strings.ContainsRune(value, utf8.MaxRune) {
+		return fmt.Errorf("%s %q contains a reserved composite key delimiter", field, value)
 	}
 
 	return nil
 }
+
+// parseDate converts to UTC so stored dates serialize with a "Z" suffix and
+// CouchDB's string comparison orders them the same way as the times.
+func parseDate(field string, value string) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse %s %q, expected RFC3339 format such as %q: %v", field, value, time.RFC3339, err)
+	}
+
+	return parsed.UTC(), nil
+}
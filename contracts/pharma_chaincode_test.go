@@ -0,0 +1,3815 @@
+package contracts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	producerMSP = "ProducerMSP"
+	supplierMSP = "SupplierMSP"
+	pharmacyMSP = "PharmacyMSP"
+
+	testManufactureDate = "2025-06-01T00:00:00Z"
+	testExpiryDate      = "2027-06-01T00:00:00Z"
+)
+
+// addTestMedicine adds a medicine owned by org with default product details
+func addTestMedicine(t *testing.T, fake *fakeLedger, org string, name string, quantity int) *Medicine {
+	t.Helper()
+
+	var medicine *Medicine
+	err := fake.invoke(org, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		medicine, err = new(PharmaChaincode).AddMedicine(ctx, name, quantity, testManufactureDate, testExpiryDate, "analgesic", "tablet", false, "tablet", 0)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("AddMedicine(%q) failed: %v", name, err)
+	}
+
+	return medicine
+}
+
+// getTestMedicine reads a medicine in its own transaction
+func getTestMedicine(t *testing.T, fake *fakeLedger, name string) *Medicine {
+	t.Helper()
+
+	var medicine *Medicine
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		medicine, err = new(PharmaChaincode).GetMedicine(ctx, name)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetMedicine(%q) failed: %v", name, err)
+	}
+
+	return medicine
+}
+
+func TestContractMetadata(t *testing.T) {
+	// contractapi rejects transaction functions whose signatures it cannot
+	// serialize when the chaincode is created
+	_, err := contractapi.NewChaincode(new(PharmaChaincode))
+	if err != nil {
+		t.Fatalf("NewChaincode failed: %v", err)
+	}
+}
+
+func TestAddMedicine(t *testing.T) {
+	tests := []struct {
+		name            string
+		medicineName    string
+		quantity        int
+		manufactureDate string
+		expiryDate      string
+		unit            string
+		minStockLevel   int
+		wantErr         string
+	}{
+		{name: "valid", medicineName: "Paracetamol", quantity: 100, manufactureDate: testManufactureDate, expiryDate: testExpiryDate, unit: "tablet"},
+		{name: "default unit", medicineName: "Ibuprofen", quantity: 5, manufactureDate: testManufactureDate, expiryDate: testExpiryDate},
+		{name: "empty name", quantity: 100, manufactureDate: testManufactureDate, expiryDate: testExpiryDate, wantErr: "name must not be empty"},
+		{name: "zero quantity", medicineName: "Aspirin", manufactureDate: testManufactureDate, expiryDate: testExpiryDate, wantErr: "quantity must be positive"},
+		{name: "bad date", medicineName: "Aspirin", quantity: 1, manufactureDate: "2025-06-01", expiryDate: testExpiryDate, wantErr: "failed to parse manufacture date"},
+		{name: "expiry before manufacture", medicineName: "Aspirin", quantity: 1, manufactureDate: testExpiryDate, expiryDate: testManufactureDate, wantErr: "must be before expiry date"},
+		{name: "unknown unit", medicineName: "Aspirin", quantity: 1, manufactureDate: testManufactureDate, expiryDate: testExpiryDate, unit: "crate", wantErr: "not one of the supported units"},
+		{name: "negative minimum stock", medicineName: "Aspirin", quantity: 1, manufactureDate: testManufactureDate, expiryDate: testExpiryDate, minStockLevel: -1, wantErr: "minimum stock level must not be negative"},
+		{name: "duplicate", medicineName: "Existing", quantity: 1, manufactureDate: testManufactureDate, expiryDate: testExpiryDate, wantErr: ErrMedicineExists.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Existing", 10)
+
+			var medicine *Medicine
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicine, err = new(PharmaChaincode).AddMedicine(ctx, tt.medicineName, tt.quantity, tt.manufactureDate, tt.expiryDate, "", "", false, tt.unit, tt.minStockLevel)
+				return err
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("AddMedicine error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddMedicine failed: %v", err)
+			}
+
+			if medicine.Owner != producerMSP {
+				t.Errorf("owner = %q, want %q", medicine.Owner, producerMSP)
+			}
+			if medicine.ID == "" {
+				t.Errorf("medicine has no ID")
+			}
+
+			stored := getTestMedicine(t, fake, tt.medicineName)
+			if stored.Quantity != tt.quantity || stored.ID != medicine.ID {
+				t.Errorf("stored medicine = %+v, want quantity %d and ID %s", stored, tt.quantity, medicine.ID)
+			}
+		})
+	}
+}
+
+func TestGetMedicine(t *testing.T) {
+	fake := newFakeLedger(t)
+	addTestMedicine(t, fake, producerMSP, "Paracetamol", 100)
+	addTestMedicine(t, fake, producerMSP, "Archived", 10)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := new(PharmaChaincode).DeleteMedicine(ctx, "Archived")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("DeleteMedicine failed: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		medicineName string
+		wantQuantity int
+		wantErr      error
+	}{
+		{name: "existing", medicineName: "Paracetamol", wantQuantity: 100},
+		{name: "missing", medicineName: "Unknown", wantErr: ErrMedicineNotFound},
+		{name: "archived", medicineName: "Archived", wantErr: ErrMedicineNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var medicine *Medicine
+			err := fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicine, err = new(PharmaChaincode).GetMedicine(ctx, tt.medicineName)
+				return err
+			})
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("GetMedicine error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetMedicine failed: %v", err)
+			}
+			if medicine.Name != tt.medicineName || medicine.Quantity != tt.wantQuantity {
+				t.Errorf("GetMedicine = %+v, want %s with quantity %d", medicine, tt.medicineName, tt.wantQuantity)
+			}
+		})
+	}
+}
+
+func TestListMedicines(t *testing.T) {
+	tests := []struct {
+		name      string
+		add       []string
+		archive   []string
+		wantNames []string
+	}{
+		{name: "empty ledger", wantNames: []string{}},
+		{name: "sorted by name", add: []string{"Zinc", "Aspirin", "Morphine"}, wantNames: []string{"Aspirin", "Morphine", "Zinc"}},
+		{name: "archived hidden", add: []string{"Aspirin", "Zinc"}, archive: []string{"Zinc"}, wantNames: []string{"Aspirin"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			for _, name := range tt.add {
+				addTestMedicine(t, fake, producerMSP, name, 10)
+			}
+			for _, name := range tt.archive {
+				err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+					_, err := new(PharmaChaincode).DeleteMedicine(ctx, name)
+					return err
+				})
+				if err != nil {
+					t.Fatalf("DeleteMedicine(%q) failed: %v", name, err)
+				}
+			}
+
+			var medicines []*Medicine
+			err := fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicines, err = new(PharmaChaincode).ListMedicines(ctx)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("ListMedicines failed: %v", err)
+			}
+
+			// Clients expect an array, never null
+			if medicines == nil {
+				t.Fatalf("ListMedicines returned nil")
+			}
+
+			names := []string{}
+			for _, medicine := range medicines {
+				names = append(names, medicine.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Errorf("ListMedicines names = %v, want %v", names, tt.wantNames)
+			}
+
+			var medicinesJSON string
+			err = fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicinesJSON, err = new(PharmaChaincode).ListMedicinesJSON(ctx)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("ListMedicinesJSON failed: %v", err)
+			}
+			if len(tt.wantNames) == 0 && medicinesJSON != "[]" {
+				t.Errorf("ListMedicinesJSON = %s, want []", medicinesJSON)
+			}
+
+			var decoded []*Medicine
+			err = json.Unmarshal([]byte(medicinesJSON), &decoded)
+			if err != nil {
+				t.Fatalf("failed to unmarshal ListMedicinesJSON result %s: %v", medicinesJSON, err)
+			}
+			if len(decoded) != len(medicines) {
+				t.Errorf("ListMedicinesJSON has %d medicines, want %d", len(decoded), len(medicines))
+			}
+		})
+	}
+}
+
+func TestEmptyResultsMarshalAsArrays(t *testing.T) {
+	tests := []struct {
+		name  string
+		query func(ctx contractapi.TransactionContextInterface) (interface{}, error)
+	}{
+		{
+			name: "ShowMedicineHistory",
+			query: func(ctx contractapi.TransactionContextInterface) (interface{}, error) {
+				return new(PharmaChaincode).ShowMedicineHistory(ctx, "Unknown")
+			},
+		},
+		{
+			name: "ShowMedicineHistoryJSON",
+			query: func(ctx contractapi.TransactionContextInterface) (interface{}, error) {
+				historyJSON, err := new(PharmaChaincode).ShowMedicineHistoryJSON(ctx, "Unknown")
+				return json.RawMessage(historyJSON), err
+			},
+		},
+		{
+			name: "ListRequests",
+			query: func(ctx contractapi.TransactionContextInterface) (interface{}, error) {
+				return new(PharmaChaincode).ListRequests(ctx)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+			var result interface{}
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				result, err = tt.query(ctx)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("%s failed: %v", tt.name, err)
+			}
+
+			// Clients expect an array, never null
+			resultJSON, err := json.Marshal(result)
+			if err != nil {
+				t.Fatalf("failed to marshal %s result: %v", tt.name, err)
+			}
+			if string(resultJSON) != "[]" {
+				t.Errorf("%s = %s, want []", tt.name, resultJSON)
+			}
+		})
+	}
+}
+
+func TestShowMedicineHistoryJSONFormatsTimestamps(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Paracetamol", 100)
+	addedAt := fake.clock
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RestockMedicine(ctx, "Paracetamol", 20)
+	})
+	if err != nil {
+		t.Fatalf("RestockMedicine failed: %v", err)
+	}
+	restockedAt := fake.clock
+
+	var historyJSON string
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		historyJSON, err = contract.ShowMedicineHistoryJSON(ctx, "Paracetamol")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ShowMedicineHistoryJSON failed: %v", err)
+	}
+
+	// Decode the timestamps as plain strings to check their exact format
+	var entries []struct {
+		Value     Medicine `json:"value"`
+		Timestamp string   `json:"timestamp"`
+	}
+	err = json.Unmarshal([]byte(historyJSON), &entries)
+	if err != nil {
+		t.Fatalf("failed to unmarshal history JSON %s: %v", historyJSON, err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("history has %d entries, want 2", len(entries))
+	}
+
+	want := []struct {
+		timestamp string
+		quantity  int
+	}{
+		{timestamp: restockedAt.Format(time.RFC3339), quantity: 120},
+		{timestamp: addedAt.Format(time.RFC3339), quantity: 100},
+	}
+	for i, entry := range entries {
+		if entry.Timestamp != want[i].timestamp || entry.Value.Quantity != want[i].quantity {
+			t.Errorf("entry %d = %s with quantity %d, want %s with quantity %d", i, entry.Timestamp, entry.Value.Quantity, want[i].timestamp, want[i].quantity)
+		}
+	}
+}
+
+func TestMedicineHistorySurvivesPurge(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Paracetamol", 100)
+	addedAt := fake.clock
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RestockMedicine(ctx, "Paracetamol", 20)
+	})
+	if err != nil {
+		t.Fatalf("RestockMedicine failed: %v", err)
+	}
+
+	err = fake.invoke(regulatorMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.PurgeMedicine(ctx, "Paracetamol")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("PurgeMedicine failed: %v", err)
+	}
+	purgedAt := fake.clock
+
+	var history []*MedicineHistory
+	err = fake.invoke(regulatorMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		history, err = contract.ShowMedicineHistory(ctx, "Paracetamol")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ShowMedicineHistory failed: %v", err)
+	}
+	if len(history) != 3 || !history[0].IsDelete || history[1].Value.Quantity != 120 || history[2].Value.Quantity != 100 {
+		t.Fatalf("history after purge = %+v, want delete marker, restock and add, newest first", history)
+	}
+
+	err = fake.invoke(regulatorMSP, func(ctx contractapi.TransactionContextInterface) error {
+		medicine, err := contract.GetMedicineAtTime(ctx, "Paracetamol", addedAt.Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		if medicine.Quantity != 100 {
+			t.Errorf("quantity at %s = %d, want 100", addedAt, medicine.Quantity)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("GetMedicineAtTime before purge failed: %v", err)
+	}
+
+	err = fake.invoke(regulatorMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.GetMedicineAsOf(ctx, "Paracetamol", purgedAt.Format(time.RFC3339))
+		return err
+	})
+	if !errors.Is(err, ErrMedicineNotFound) || !strings.Contains(err.Error(), "was deleted") {
+		t.Fatalf("GetMedicineAsOf after purge error = %v, want a deleted error", err)
+	}
+
+	// The name can be reused and resolves to the new record only
+	medicine := addTestMedicine(t, fake, producerMSP, "Paracetamol", 5)
+	if stored := getTestMedicine(t, fake, "Paracetamol"); stored.ID != medicine.ID {
+		t.Errorf("GetMedicine after re-add = %s, want %s", stored.ID, medicine.ID)
+	}
+}
+
+func TestRenamedMedicineHistoryStaysWithName(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Old", 10)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RenameMedicine(ctx, "Old", "New")
+	})
+	if err != nil {
+		t.Fatalf("RenameMedicine failed: %v", err)
+	}
+
+	for name, wantEntries := range map[string]int{"Old": 2, "New": 1} {
+		var history []*MedicineHistory
+		err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			var err error
+			history, err = contract.ShowMedicineHistory(ctx, name)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("ShowMedicineHistory(%q) failed: %v", name, err)
+		}
+		if len(history) != wantEntries {
+			t.Fatalf("history of %s has %d entries, want %d", name, len(history), wantEntries)
+		}
+		for _, entry := range history {
+			if entry.Value.Name != name {
+				t.Errorf("history of %s contains a value named %s", name, entry.Value.Name)
+			}
+		}
+	}
+}
+
+func TestGetMedicineKeys(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Zinc", 10)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	// Renaming leaves a tombstone, and a request adds auxiliary keys
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RenameMedicine(ctx, "Zinc", "Zinc Sulfate")
+	})
+	if err != nil {
+		t.Fatalf("RenameMedicine failed: %v", err)
+	}
+	err = fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.RequestMedicine(ctx, "Aspirin", "urgent", 5)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RequestMedicine failed: %v", err)
+	}
+
+	var keys []string
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		keys, err = contract.GetMedicineKeys(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetMedicineKeys failed: %v", err)
+	}
+
+	want := "Aspirin,Zinc,Zinc Sulfate"
+	if strings.Join(keys, ",") != want {
+		t.Errorf("GetMedicineKeys = %v, want %s", keys, want)
+	}
+}
+
+func TestConcurrentInvocationsAreAllCounted(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	// Both adjustments are endorsed against the same state before either
+	// commits, as happens when two clients submit at once
+	first, second := fake.tx(producerMSP), fake.tx(producerMSP)
+	for _, tx := range []*fakeTx{first, second} {
+		err := tx.endorse(func(ctx contractapi.TransactionContextInterface) error {
+			return contract.AdjustQuantity(ctx, "Aspirin", -1)
+		})
+		if err != nil {
+			t.Fatalf("AdjustQuantity failed: %v", err)
+		}
+	}
+	first.commit()
+	second.commit()
+
+	var metrics map[string]int
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		metrics, err = contract.GetMetrics(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetMetrics failed: %v", err)
+	}
+
+	if metrics["AdjustQuantity"] != 2 {
+		t.Errorf("AdjustQuantity was counted %d times, want 2", metrics["AdjustQuantity"])
+	}
+	if metrics["AddMedicine"] != 1 {
+		t.Errorf("AddMedicine was counted %d times, want 1", metrics["AddMedicine"])
+	}
+}
+
+func TestCompactMetrics(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, producerMSP, "Ibuprofen", 10)
+
+	// A retried submission is not counted again
+	for i := 0; i < 2; i++ {
+		tx := fake.tx(producerMSP)
+		tx.transient[idempotencyTransientKey] = []byte("retry-1")
+		err := tx.run(func(ctx contractapi.TransactionContextInterface) error {
+			return contract.AdjustQuantity(ctx, "Aspirin", -1)
+		})
+		if err != nil {
+			t.Fatalf("AdjustQuantity attempt %d failed: %v", i+1, err)
+		}
+	}
+
+	getMetrics := func() map[string]int {
+		t.Helper()
+
+		var metrics map[string]int
+		err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			var err error
+			metrics, err = contract.GetMetrics(ctx)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("GetMetrics failed: %v", err)
+		}
+		return metrics
+	}
+	compact := func(org string) (int, error) {
+		var folded int
+		err := fake.invoke(org, func(ctx contractapi.TransactionContextInterface) error {
+			var err error
+			folded, err = contract.CompactMetrics(ctx)
+			return err
+		})
+		return folded, err
+	}
+	metricsKeys := func() int {
+		count := 0
+		for key := range fake.state {
+			if strings.HasPrefix(key, compositeKeyNamespace+metricsObjectType+compositeKeyNamespace) {
+				count++
+			}
+		}
+		return count
+	}
+
+	want := map[string]int{"AddMedicine": 2, "AdjustQuantity": 1}
+	if metrics := getMetrics(); !reflect.DeepEqual(metrics, want) {
+		t.Fatalf("GetMetrics = %v, want %v", metrics, want)
+	}
+
+	_, err := compact(producerMSP)
+	if err == nil || !strings.Contains(err.Error(), "only RegulatorMSP may compact metrics") {
+		t.Fatalf("CompactMetrics as producer error = %v, want a regulator error", err)
+	}
+
+	folded, err := compact(regulatorMSP)
+	if err != nil {
+		t.Fatalf("CompactMetrics failed: %v", err)
+	}
+	if folded != 3 || metricsKeys() != 2 {
+		t.Errorf("CompactMetrics folded %d keys leaving %d, want 3 leaving 2", folded, metricsKeys())
+	}
+	if metrics := getMetrics(); !reflect.DeepEqual(metrics, want) {
+		t.Errorf("GetMetrics after compaction = %v, want %v", metrics, want)
+	}
+
+	// Later invocations add to the compacted totals
+	addTestMedicine(t, fake, producerMSP, "Zinc", 10)
+	folded, err = compact(regulatorMSP)
+	if err != nil {
+		t.Fatalf("CompactMetrics failed: %v", err)
+	}
+	want["AddMedicine"] = 3
+	if metrics := getMetrics(); folded != 1 || !reflect.DeepEqual(metrics, want) {
+		t.Errorf("second compaction folded %d keys into %v, want 1 into %v", folded, metrics, want)
+	}
+}
+
+// newTestSigner creates an ECDSA key and a self-signed certificate for it,
+// valid for the whole period the fake ledger clock covers.
+func newTestSigner(t *testing.T) (*ecdsa.PrivateKey, []byte, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test Manufacturer"},
+		NotBefore:    time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	fingerprint := sha256.Sum256(der)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return key, certPEM, hex.EncodeToString(fingerprint[:])
+}
+
+// signTestAttestation signs the attestation payload for the given arguments
+func signTestAttestation(t *testing.T, key *ecdsa.PrivateKey, name string, quantity int) string {
+	t.Helper()
+
+	payloadJSON, err := json.Marshal(attestationPayload{
+		Name:            name,
+		Quantity:        quantity,
+		ManufactureDate: testManufactureDate,
+		ExpiryDate:      testExpiryDate,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal payload: %v", err)
+	}
+
+	hash := sha256.Sum256(payloadJSON)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("failed to sign payload: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestAddMedicineWithAttestation(t *testing.T) {
+	trustedKey, trustedCert, trustedFingerprint := newTestSigner(t)
+	untrustedKey, untrustedCert, _ := newTestSigner(t)
+
+	tests := []struct {
+		name     string
+		cert     []byte
+		quantity int
+		sign     func(t *testing.T) string
+		wantErr  string
+	}{
+		{
+			name:     "trusted signer",
+			cert:     trustedCert,
+			quantity: 100,
+			sign:     func(t *testing.T) string { return signTestAttestation(t, trustedKey, "Aspirin", 100) },
+		},
+		{
+			name:     "tampered quantity",
+			cert:     trustedCert,
+			quantity: 1000,
+			sign:     func(t *testing.T) string { return signTestAttestation(t, trustedKey, "Aspirin", 100) },
+			wantErr:  "does not match",
+		},
+		{
+			name:     "untrusted signer",
+			cert:     untrustedCert,
+			quantity: 100,
+			sign:     func(t *testing.T) string { return signTestAttestation(t, untrustedKey, "Aspirin", 100) },
+			wantErr:  "not trusted",
+		},
+		{
+			name:     "certificate does not match signature",
+			cert:     trustedCert,
+			quantity: 100,
+			sign:     func(t *testing.T) string { return signTestAttestation(t, untrustedKey, "Aspirin", 100) },
+			wantErr:  "does not match",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+
+			err := fake.invoke(regulatorMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.SetTrustedAttestationCerts(ctx, `["`+trustedFingerprint+`"]`)
+			})
+			if err != nil {
+				t.Fatalf("SetTrustedAttestationCerts failed: %v", err)
+			}
+
+			tx := fake.tx(producerMSP)
+			tx.transient[attestationCertTransientKey] = tt.cert
+			var medicine *Medicine
+			err = tx.run(func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicine, err = contract.AddMedicineWithAttestation(ctx, "Aspirin", tt.quantity, testManufactureDate, testExpiryDate, tt.sign(t))
+				return err
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("AddMedicineWithAttestation error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddMedicineWithAttestation failed: %v", err)
+			}
+			if medicine.AttestationCertFingerprint != trustedFingerprint {
+				t.Errorf("AttestationCertFingerprint = %s, want %s", medicine.AttestationCertFingerprint, trustedFingerprint)
+			}
+			if medicine.AttestationPayloadHash == "" {
+				t.Errorf("AttestationPayloadHash is empty")
+			}
+		})
+	}
+}
+
+func TestSetTrustedAttestationCertsRequiresRegulator(t *testing.T) {
+	fake := newFakeLedger(t)
+	_, _, fingerprint := newTestSigner(t)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return new(PharmaChaincode).SetTrustedAttestationCerts(ctx, `["`+fingerprint+`"]`)
+	})
+	if err == nil {
+		t.Fatalf("a producer was allowed to set the attestation trust list")
+	}
+}
+
+func TestSplitMedicineExpiredStock(t *testing.T) {
+	tests := []struct {
+		name     string
+		newOwner string
+		wantErr  bool
+	}{
+		{name: "to another organization", newOwner: pharmacyMSP, wantErr: true},
+		{name: "within the owner", newOwner: producerMSP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+			// Let the lot expire before it is split
+			fake.clock = time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC)
+
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.SplitMedicine(ctx, "Aspirin", 4, "Aspirin B", tt.newOwner)
+			})
+			if tt.wantErr && err == nil {
+				t.Fatalf("expired stock was split off to %s", tt.newOwner)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("SplitMedicine failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestTransfersRejectSelfAndEmptyOwner(t *testing.T) {
+	const wantDifferent = "new owner must be a different organization than ProducerMSP"
+
+	transfers := []struct {
+		name     string
+		transfer func(ctx contractapi.TransactionContextInterface, contract *PharmaChaincode, newOwner string) error
+		wantErr  string
+		// Splitting within the owner is allowed, so only an empty owner fails
+		allowSelf bool
+	}{
+		{
+			name: "InitiateTransfer",
+			transfer: func(ctx contractapi.TransactionContextInterface, contract *PharmaChaincode, newOwner string) error {
+				return contract.InitiateTransfer(ctx, "Aspirin", newOwner)
+			},
+			wantErr: wantDifferent,
+		},
+		{
+			name: "DonateMedicine",
+			transfer: func(ctx contractapi.TransactionContextInterface, contract *PharmaChaincode, newOwner string) error {
+				return contract.DonateMedicine(ctx, "Aspirin", newOwner, "relief")
+			},
+			wantErr: wantDifferent,
+		},
+		{
+			name: "TransferAllMedicines",
+			transfer: func(ctx contractapi.TransactionContextInterface, contract *PharmaChaincode, newOwner string) error {
+				return contract.TransferAllMedicines(ctx, newOwner)
+			},
+			wantErr: wantDifferent,
+		},
+		{
+			name: "TransferAllFromOwner",
+			transfer: func(ctx contractapi.TransactionContextInterface, contract *PharmaChaincode, newOwner string) error {
+				_, err := contract.TransferAllFromOwner(ctx, producerMSP, newOwner)
+				return err
+			},
+			wantErr: wantDifferent,
+		},
+		{
+			name: "ReturnMedicine",
+			transfer: func(ctx contractapi.TransactionContextInterface, contract *PharmaChaincode, newOwner string) error {
+				return contract.ReturnMedicine(ctx, "Aspirin", 2, newOwner, "unsold")
+			},
+			wantErr: "medicine must be returned to another organization",
+		},
+		{
+			name: "SplitMedicine",
+			transfer: func(ctx contractapi.TransactionContextInterface, contract *PharmaChaincode, newOwner string) error {
+				return contract.SplitMedicine(ctx, "Aspirin", 2, "Aspirin B", newOwner)
+			},
+			wantErr:   "new owner must not be empty",
+			allowSelf: true,
+		},
+	}
+
+	for _, tr := range transfers {
+		for _, target := range []struct{ name, newOwner string }{
+			{name: "empty owner", newOwner: ""},
+			{name: "self", newOwner: producerMSP},
+		} {
+			newOwner := target.newOwner
+			if newOwner != "" && tr.allowSelf {
+				continue
+			}
+
+			t.Run(tr.name+" "+target.name, func(t *testing.T) {
+				fake := newFakeLedger(t)
+				addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+				err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+					return tr.transfer(ctx, new(PharmaChaincode), newOwner)
+				})
+				if err == nil || !strings.Contains(err.Error(), tr.wantErr) {
+					t.Fatalf("%s error = %v, want it to contain %q", tr.name, err, tr.wantErr)
+				}
+
+				medicine := getTestMedicine(t, fake, "Aspirin")
+				if medicine.Owner != producerMSP || medicine.PendingOwner != "" || medicine.Quantity != 10 {
+					t.Errorf("medicine after rejected %s = %d owned by %s pending %q, want unchanged", tr.name, medicine.Quantity, medicine.Owner, medicine.PendingOwner)
+				}
+			})
+		}
+	}
+}
+
+func TestRenameMedicineMovesSerials(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.AddMedicine(ctx, "Morphine", 2, testManufactureDate, testExpiryDate, "analgesic", "injection", true, "vial", 0)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("AddMedicine failed: %v", err)
+	}
+	for _, serial := range []string{"S1", "S2"} {
+		err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			return contract.RegisterSerial(ctx, "Morphine", serial)
+		})
+		if err != nil {
+			t.Fatalf("RegisterSerial(%s) failed: %v", serial, err)
+		}
+	}
+
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RenameMedicine(ctx, "Morphine", "Morphine Sulfate")
+	})
+	if err != nil {
+		t.Fatalf("RenameMedicine failed: %v", err)
+	}
+
+	serials := map[string]int{}
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		for _, name := range []string{"Morphine", "Morphine Sulfate"} {
+			units, err := contract.GetSerials(ctx, name)
+			if err != nil {
+				return err
+			}
+			for _, unit := range units {
+				if unit.MedicineName != name {
+					t.Errorf("serial %s under %s names medicine %s", unit.Serial, name, unit.MedicineName)
+				}
+			}
+			serials[name] = len(units)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("GetSerials failed: %v", err)
+	}
+	if serials["Morphine"] != 0 || serials["Morphine Sulfate"] != 2 {
+		t.Errorf("serials by name = %v, want all 2 under Morphine Sulfate", serials)
+	}
+
+	// The moved serials still count against the renamed lot
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RegisterSerial(ctx, "Morphine Sulfate", "S3")
+	})
+	if err == nil {
+		t.Errorf("a third serial was registered for a lot of 2")
+	}
+}
+
+func TestQuantityDeltasCountTowardsStock(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.AdjustQuantity(ctx, "Aspirin", -8)
+	})
+	if err != nil {
+		t.Fatalf("AdjustQuantity failed: %v", err)
+	}
+
+	// Only 2 units are left, so neither a split nor a request may take 5
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SplitMedicine(ctx, "Aspirin", 5, "Aspirin B", producerMSP)
+	})
+	if err == nil {
+		t.Errorf("split 5 units off a lot with 2 available")
+	}
+	err = fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.RequestMedicine(ctx, "Aspirin", "urgent", 5)
+		return err
+	})
+	if err == nil {
+		t.Errorf("requested 5 units of a lot with 2 available")
+	}
+
+	var summary *InventorySummary
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		summary, err = contract.GetInventorySummary(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetInventorySummary failed: %v", err)
+	}
+	if summary.ActiveQuantityByUnit["tablet"] != 2 {
+		t.Errorf("active tablets = %d, want 2", summary.ActiveQuantityByUnit["tablet"])
+	}
+}
+
+func TestQuantityDeltasFoldIntoRemainingStock(t *testing.T) {
+	tests := []struct {
+		name string
+		take func(ctx contractapi.TransactionContextInterface) error
+	}{
+		{
+			name: "split",
+			take: func(ctx contractapi.TransactionContextInterface) error {
+				return new(PharmaChaincode).SplitMedicine(ctx, "Aspirin", 12, "Aspirin B", pharmacyMSP)
+			},
+		},
+		{
+			name: "return",
+			take: func(ctx contractapi.TransactionContextInterface) error {
+				return new(PharmaChaincode).ReturnMedicine(ctx, "Aspirin", 12, supplierMSP, "overstock")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.AdjustQuantity(ctx, "Aspirin", 5)
+			})
+			if err != nil {
+				t.Fatalf("AdjustQuantity failed: %v", err)
+			}
+
+			// 12 of the 15 available units are more than the base quantity
+			err = fake.invoke(producerMSP, tt.take)
+			if err != nil {
+				t.Fatalf("taking 12 units failed: %v", err)
+			}
+
+			var quantity int
+			var report *HistoryReport
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				quantity, err = contract.GetEffectiveQuantity(ctx, "Aspirin")
+				if err != nil {
+					return err
+				}
+				report, err = contract.VerifyMedicineHistory(ctx, "Aspirin")
+				return err
+			})
+			if err != nil {
+				t.Fatalf("reading Aspirin failed: %v", err)
+			}
+
+			if source := getTestMedicine(t, fake, "Aspirin"); source.Quantity != 3 || quantity != 3 {
+				t.Errorf("remaining quantity = %d stored and %d effective, want 3 and 3", source.Quantity, quantity)
+			}
+			if len(report.Violations) != 0 {
+				t.Errorf("VerifyMedicineHistory violations = %+v, want none", report.Violations)
+			}
+		})
+	}
+}
+
+func TestPurgeMedicineRemovesQuantityDeltas(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.AdjustQuantity(ctx, "Aspirin", -3)
+	})
+	if err != nil {
+		t.Fatalf("AdjustQuantity failed: %v", err)
+	}
+	err = fake.invoke(regulatorMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.PurgeMedicine(ctx, "Aspirin")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("PurgeMedicine failed: %v", err)
+	}
+
+	// A new lot under the purged name starts from its own quantity
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	var quantity int
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		quantity, err = contract.GetEffectiveQuantity(ctx, "Aspirin")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetEffectiveQuantity failed: %v", err)
+	}
+	if quantity != 10 {
+		t.Errorf("effective quantity = %d, want 10", quantity)
+	}
+}
+
+func TestMedicineDatesAreStoredInUTC(t *testing.T) {
+	fake := newFakeLedger(t)
+
+	var medicine *Medicine
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		medicine, err = new(PharmaChaincode).AddMedicine(ctx, "Aspirin", 10, "2025-06-01T02:00:00+02:00", "2027-06-01T00:00:00-05:00", "", "", false, "", 0)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("AddMedicine failed: %v", err)
+	}
+
+	stored := fake.state[medicine.ID]
+	for _, want := range []string{`"manufactureDate":"2025-06-01T00:00:00Z"`, `"expiryDate":"2027-06-01T05:00:00Z"`} {
+		if !strings.Contains(string(stored), want) {
+			t.Errorf("stored record %s does not contain %s", stored, want)
+		}
+	}
+}
+
+func TestQueryByManufactureRangeFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		queryErr  error
+		wantNames string
+		wantErr   string
+	}{
+		{name: "leveldb scans instead", queryErr: errors.New("ExecuteQuery not supported for leveldb"), wantNames: "Aspirin"},
+		{name: "other failures are returned", queryErr: errors.New("couchdb timed out"), wantErr: "couchdb timed out"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.AddMedicine(ctx, "Ibuprofen", 10, "2024-01-01T00:00:00Z", testExpiryDate, "", "", false, "", 0)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("AddMedicine failed: %v", err)
+			}
+			fake.queryErr = tt.queryErr
+
+			var medicines []*Medicine
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicines, err = contract.QueryByManufactureRange(ctx, "2025-01-01T00:00:00Z", "2025-12-31T00:00:00Z")
+				return err
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("QueryByManufactureRange error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("QueryByManufactureRange failed: %v", err)
+			}
+
+			var names []string
+			for _, medicine := range medicines {
+				names = append(names, medicine.Name)
+			}
+			if strings.Join(names, ",") != tt.wantNames {
+				t.Errorf("QueryByManufactureRange = %v, want %s", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestRichQueryFallback(t *testing.T) {
+	leveldbErr := errors.New("ExecuteQuery not supported for leveldb")
+
+	tests := []struct {
+		name      string
+		queryErr  error
+		query     func(ctx contractapi.TransactionContextInterface) ([]*Medicine, error)
+		wantNames string
+		wantErr   string
+	}{
+		{
+			name:     "owner on leveldb",
+			queryErr: leveldbErr,
+			query: func(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+				return new(PharmaChaincode).QueryMedicinesByOwner(ctx, producerMSP)
+			},
+			wantNames: "Aspirin",
+		},
+		{
+			name:     "category on leveldb",
+			queryErr: leveldbErr,
+			query: func(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+				return new(PharmaChaincode).QueryMedicinesByCategory(ctx, "antibiotic")
+			},
+			wantNames: "Amoxicillin",
+		},
+		{
+			name: "category on couchdb",
+			query: func(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+				return new(PharmaChaincode).QueryMedicinesByCategory(ctx, "analgesic")
+			},
+			wantNames: "Aspirin",
+		},
+		{
+			name:     "unrelated unsupported operation",
+			queryErr: errors.New("operation not supported by the gateway"),
+			query: func(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+				return new(PharmaChaincode).QueryMedicinesByOwner(ctx, producerMSP)
+			},
+			wantErr: "operation not supported by the gateway",
+		},
+		{
+			name:     "selector on leveldb",
+			queryErr: leveldbErr,
+			query: func(ctx contractapi.TransactionContextInterface) ([]*Medicine, error) {
+				return new(PharmaChaincode).QueryMedicinesWithSelector(ctx, `{"selector":{"owner":"ProducerMSP"}}`)
+			},
+			wantErr: ErrRichQueryUnsupported.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			err := fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := new(PharmaChaincode).AddMedicine(ctx, "Amoxicillin", 10, testManufactureDate, testExpiryDate, "antibiotic", "capsule", false, "capsule", 0)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("AddMedicine failed: %v", err)
+			}
+			fake.queryErr = tt.queryErr
+
+			var medicines []*Medicine
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicines, err = tt.query(ctx)
+				return err
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("query error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if tt.queryErr == leveldbErr && !errors.Is(err, ErrRichQueryUnsupported) {
+					t.Errorf("query error = %v, want it to wrap ErrRichQueryUnsupported", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+
+			var names []string
+			for _, medicine := range medicines {
+				names = append(names, medicine.Name)
+			}
+			if strings.Join(names, ",") != tt.wantNames {
+				t.Errorf("query = %v, want %s", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestRequestMedicinePrivateSaltsTheHash(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	details := []byte("ward 7, deliver by Friday")
+
+	tests := []struct {
+		name    string
+		salt    []byte
+		wantErr string
+	}{
+		{name: "salted", salt: salt},
+		{name: "missing salt", wantErr: "salt of at least"},
+		{name: "short salt", salt: []byte("abc"), wantErr: "salt of at least"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+			tx := fake.tx(supplierMSP)
+			tx.transient[requestDetailsTransientKey] = details
+			if tt.salt != nil {
+				tx.transient[requestSaltTransientKey] = tt.salt
+			}
+			var request *MedicineRequest
+			err := tx.run(func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				request, err = new(PharmaChaincode).RequestMedicinePrivate(ctx, "Aspirin", 5)
+				return err
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("RequestMedicinePrivate error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RequestMedicinePrivate failed: %v", err)
+			}
+
+			unsalted := sha256.Sum256(details)
+			salted := sha256.Sum256(append(append([]byte{}, salt...), details...))
+			if request.DetailsHash == hex.EncodeToString(unsalted[:]) {
+				t.Errorf("DetailsHash is the unsalted hash of the details")
+			}
+			if request.DetailsHash != hex.EncodeToString(salted[:]) {
+				t.Errorf("DetailsHash = %s, want the hash of salt and details", request.DetailsHash)
+			}
+		})
+	}
+}
+
+func TestGetMedicineJSONHidesRemovedRecords(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, producerMSP, "Zinc", 10)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.DeleteMedicine(ctx, "Aspirin")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("DeleteMedicine failed: %v", err)
+	}
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RenameMedicine(ctx, "Zinc", "Zinc Sulfate")
+	})
+	if err != nil {
+		t.Fatalf("RenameMedicine failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		wantErr  bool
+		contains string
+	}{
+		{name: "Aspirin", wantErr: true},
+		{name: "Zinc", wantErr: true},
+		{name: "Zinc Sulfate", contains: `"previousName":"Zinc"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var medicineJSON string
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicineJSON, err = contract.GetMedicineJSON(ctx, tt.name)
+				return err
+			})
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrMedicineNotFound) {
+					t.Fatalf("GetMedicineJSON error = %v, want %v", err, ErrMedicineNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetMedicineJSON failed: %v", err)
+			}
+			if !strings.Contains(medicineJSON, tt.contains) {
+				t.Errorf("GetMedicineJSON = %s, want it to contain %s", medicineJSON, tt.contains)
+			}
+		})
+	}
+}
+
+func TestQuarantineBlocksTransfers(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.QuarantineMedicine(ctx, "Aspirin", "failed inspection")
+	})
+	if err == nil {
+		t.Fatalf("the owner was allowed to quarantine its own stock")
+	}
+	err = fake.invoke(qualityAssuranceMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.QuarantineMedicine(ctx, "Aspirin", "failed inspection")
+	})
+	if err != nil {
+		t.Fatalf("QuarantineMedicine failed: %v", err)
+	}
+
+	donate := func(ctx contractapi.TransactionContextInterface) error {
+		return contract.DonateMedicine(ctx, "Aspirin", pharmacyMSP, "relief")
+	}
+	err = fake.invoke(producerMSP, donate)
+	if err == nil || !strings.Contains(err.Error(), "quarantined") {
+		t.Fatalf("DonateMedicine error = %v, want a quarantine error", err)
+	}
+
+	err = fake.invoke(qualityAssuranceMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.ReleaseQuarantine(ctx, "Aspirin")
+	})
+	if err != nil {
+		t.Fatalf("ReleaseQuarantine failed: %v", err)
+	}
+	err = fake.invoke(producerMSP, donate)
+	if err != nil {
+		t.Fatalf("DonateMedicine after release failed: %v", err)
+	}
+}
+
+func TestIdempotencyKeyMakesRetriesNoOps(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	submit := func(method string) error {
+		tx := fake.tx(producerMSP)
+		tx.transient[idempotencyTransientKey] = []byte("retry-1")
+		return tx.run(func(ctx contractapi.TransactionContextInterface) error {
+			if method == "AdjustQuantity" {
+				return contract.AdjustQuantity(ctx, "Aspirin", 1)
+			}
+			return contract.RestockMedicine(ctx, "Aspirin", 5)
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		err := submit("RestockMedicine")
+		if err != nil {
+			t.Fatalf("RestockMedicine attempt %d failed: %v", i+1, err)
+		}
+	}
+	if medicine := getTestMedicine(t, fake, "Aspirin"); medicine.Quantity != 15 {
+		t.Errorf("quantity after a retried restock = %d, want 15", medicine.Quantity)
+	}
+
+	// The key belongs to RestockMedicine now
+	err := submit("AdjustQuantity")
+	if err == nil {
+		t.Errorf("an idempotency key was reused for a different method")
+	}
+}
+
+func TestDeleteMedicineAuthorization(t *testing.T) {
+	tests := []struct {
+		name    string
+		caller  string
+		wantErr string
+	}{
+		{name: "owner", caller: producerMSP},
+		{name: "regulator", caller: regulatorMSP},
+		{name: "other organization", caller: supplierMSP, wantErr: "only the owner ProducerMSP may delete medicine Aspirin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			added := getTestMedicine(t, fake, "Aspirin")
+
+			var snapshot *Medicine
+			err := fake.invoke(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				snapshot, err = contract.DeleteMedicine(ctx, "Aspirin")
+				return err
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("DeleteMedicine error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				getTestMedicine(t, fake, "Aspirin")
+				return
+			}
+			if err != nil {
+				t.Fatalf("DeleteMedicine failed: %v", err)
+			}
+
+			// The snapshot is the record as it was before archiving
+			if !reflect.DeepEqual(snapshot, added) {
+				t.Errorf("DeleteMedicine snapshot = %+v, want %+v", snapshot, added)
+			}
+
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.GetMedicine(ctx, "Aspirin")
+				return err
+			})
+			if !errors.Is(err, ErrMedicineNotFound) {
+				t.Errorf("GetMedicine after delete error = %v, want %v", err, ErrMedicineNotFound)
+			}
+		})
+	}
+}
+
+func TestDeleteExpiredMedicines(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Valid", 10)
+	for _, lot := range []struct{ org, name string }{{producerMSP, "Expired"}, {supplierMSP, "Supplier Expired"}} {
+		err := fake.invoke(lot.org, func(ctx contractapi.TransactionContextInterface) error {
+			_, err := contract.AddMedicine(ctx, lot.name, 10, testManufactureDate, "2026-06-01T00:00:00Z", "", "", false, "", 0)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("AddMedicine(%q) failed: %v", lot.name, err)
+		}
+	}
+	fake.clock = time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	deleteExpired := func(org string) []string {
+		t.Helper()
+
+		var deleted []string
+		err := fake.invoke(org, func(ctx contractapi.TransactionContextInterface) error {
+			var err error
+			deleted, err = contract.DeleteExpiredMedicines(ctx)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("DeleteExpiredMedicines as %s failed: %v", org, err)
+		}
+		return deleted
+	}
+
+	// An organization only clears its own expired stock
+	if deleted := deleteExpired(producerMSP); strings.Join(deleted, ",") != "Expired" {
+		t.Errorf("producer deleted %v, want only Expired", deleted)
+	}
+	if deleted := deleteExpired(regulatorMSP); strings.Join(deleted, ",") != "Supplier Expired" {
+		t.Errorf("regulator deleted %v, want only Supplier Expired", deleted)
+	}
+	if fake.lastEvent == nil || fake.lastEvent.Name != "MedicineExpired" {
+		t.Errorf("last event = %+v, want MedicineExpired", fake.lastEvent)
+	}
+
+	getTestMedicine(t, fake, "Valid")
+
+	// Expired stock is archived, so its owner can still bring it back
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RestoreMedicine(ctx, "Expired")
+	})
+	if err != nil {
+		t.Errorf("RestoreMedicine after DeleteExpiredMedicines failed: %v", err)
+	}
+}
+
+func TestDeleteAllExpired(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Valid", 10)
+	addTestMedicineExpiring(t, fake, producerMSP, "Expired A", 10, "2026-03-01T00:00:00Z")
+	addTestMedicineExpiring(t, fake, producerMSP, "Expired B", 10, "2026-06-01T00:00:00Z")
+	addTestMedicineExpiring(t, fake, supplierMSP, "Supplier Expired", 10, "2026-06-01T00:00:00Z")
+	fake.clock = time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	var count int
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		count, err = contract.DeleteAllExpired(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("DeleteAllExpired failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("DeleteAllExpired = %d, want 2", count)
+	}
+
+	var names []string
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		medicines, err := contract.ListMedicines(ctx)
+		for _, medicine := range medicines {
+			names = append(names, medicine.Name)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ListMedicines failed: %v", err)
+	}
+	if strings.Join(names, ",") != "Supplier Expired,Valid" {
+		t.Errorf("medicines after DeleteAllExpired = %v, want Supplier Expired and Valid", names)
+	}
+}
+
+func TestSplitMedicineConservesQuantity(t *testing.T) {
+	tests := []struct {
+		name          string
+		splitQuantity int
+		newName       string
+		wantErr       string
+	}{
+		{name: "part of the lot", splitQuantity: 4, newName: "Aspirin B"},
+		{name: "the whole lot", splitQuantity: 10, newName: "Aspirin B"},
+		{name: "zero", splitQuantity: 0, newName: "Aspirin B", wantErr: "must be between 1 and 10"},
+		{name: "more than on hand", splitQuantity: 11, newName: "Aspirin B", wantErr: "must be between 1 and 10"},
+		{name: "existing name", splitQuantity: 4, newName: "Existing", wantErr: ErrMedicineExists.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			addTestMedicine(t, fake, producerMSP, "Existing", 1)
+
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return new(PharmaChaincode).SplitMedicine(ctx, "Aspirin", tt.splitQuantity, tt.newName, pharmacyMSP)
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SplitMedicine error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if source := getTestMedicine(t, fake, "Aspirin"); source.Quantity != 10 {
+					t.Errorf("source quantity after a failed split = %d, want 10", source.Quantity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SplitMedicine failed: %v", err)
+			}
+
+			source := getTestMedicine(t, fake, "Aspirin")
+			split := getTestMedicine(t, fake, tt.newName)
+			if source.Quantity+split.Quantity != 10 {
+				t.Errorf("quantities after split = %d + %d, want a total of 10", source.Quantity, split.Quantity)
+			}
+			if split.Quantity != tt.splitQuantity || split.Owner != pharmacyMSP {
+				t.Errorf("split lot = %d owned by %s, want %d owned by %s", split.Quantity, split.Owner, tt.splitQuantity, pharmacyMSP)
+			}
+			if !split.ExpiryDate.Equal(source.ExpiryDate) || !split.ManufactureDate.Equal(source.ManufactureDate) {
+				t.Errorf("split lot dates differ from the source lot")
+			}
+		})
+	}
+}
+
+func TestMedicineNameValidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		medicineName string
+		wantErr      string
+	}{
+		{name: "empty", medicineName: "", wantErr: "must not be empty"},
+		{name: "too long", medicineName: strings.Repeat("a", maxMedicineNameLength+1), wantErr: "at most 256 characters"},
+		{name: "null byte", medicineName: "Aspi\x00rin", wantErr: "reserved composite key delimiter"},
+		{name: "return lot separator", medicineName: "Aspirin@ProducerMSP", wantErr: "must not contain"},
+		{name: "longest allowed", medicineName: strings.Repeat("é", maxMedicineNameLength)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.AddMedicine(ctx, tt.medicineName, 10, testManufactureDate, testExpiryDate, "", "", false, "", 0)
+				return err
+			})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("AddMedicine failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("AddMedicine error = %v, want it to contain %q", err, tt.wantErr)
+			}
+
+			err = fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.RequestMedicine(ctx, tt.medicineName, "urgent", 1)
+				return err
+			})
+			if err == nil {
+				t.Errorf("RequestMedicine accepted the name %q", tt.medicineName)
+			}
+		})
+	}
+}
+
+func TestQueryComposite(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	err := fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.RequestMedicine(ctx, "Aspirin", "urgent", 3)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RequestMedicine failed: %v", err)
+	}
+	for _, delta := range []int{2, -5} {
+		err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			return contract.AdjustQuantity(ctx, "Aspirin", delta)
+		})
+		if err != nil {
+			t.Fatalf("AdjustQuantity(%d) failed: %v", delta, err)
+		}
+	}
+
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		requests, err := queryComposite[MedicineRequest](ctx, requestObjectType, []string{supplierMSP, "Aspirin"})
+		if err != nil {
+			return err
+		}
+		if len(requests) != 1 || requests[0].Quantity != 3 {
+			t.Errorf("requests = %+v, want one request for 3 units", requests)
+		}
+
+		deltas, err := queryComposite[int](ctx, quantityDeltaObjectType, []string{"Aspirin"})
+		if err != nil {
+			return err
+		}
+		if len(deltas) != 2 || *deltas[0]+*deltas[1] != -3 {
+			t.Errorf("deltas = %v, want 2 and -5", deltas)
+		}
+
+		// Records of another type fail to decode instead of coming back empty
+		_, err = queryComposite[int](ctx, requestObjectType, []string{})
+		if err == nil {
+			t.Errorf("requests were decoded as ints")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("queryComposite failed: %v", err)
+	}
+}
+
+func TestControlledTransferLimit(t *testing.T) {
+	originalLimit := maxControlledTransfer
+	maxControlledTransfer = 5
+	t.Cleanup(func() { maxControlledTransfer = originalLimit })
+
+	tests := []struct {
+		name       string
+		controlled bool
+		quantity   int
+		wantErr    bool
+	}{
+		{name: "at the limit", controlled: true, quantity: 5},
+		{name: "over the limit", controlled: true, quantity: 6, wantErr: true},
+		{name: "uncontrolled over the limit", quantity: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.AddMedicine(ctx, "Morphine", tt.quantity, testManufactureDate, testExpiryDate, "", "", tt.controlled, "vial", 0)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("AddMedicine failed: %v", err)
+			}
+
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.InitiateTransfer(ctx, "Morphine", pharmacyMSP)
+			})
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "the limit per transfer is 5") {
+					t.Fatalf("InitiateTransfer error = %v, want the transfer limit error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("InitiateTransfer failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestMedicineAttributes(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	for _, value := range []string{"2-8C", "15-25C"} {
+		err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			return contract.SetMedicineAttribute(ctx, "Aspirin", "storageTemp", value)
+		})
+		if err != nil {
+			t.Fatalf("SetMedicineAttribute(%q) failed: %v", value, err)
+		}
+	}
+
+	var value string
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		value, err = contract.GetMedicineAttribute(ctx, "Aspirin", "storageTemp")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetMedicineAttribute failed: %v", err)
+	}
+	if value != "15-25C" {
+		t.Errorf("storageTemp = %q, want the overwritten value 15-25C", value)
+	}
+
+	invalid := []struct{ key, value string }{
+		{"", "x"},
+		{strings.Repeat("k", maxAttributeKeyLength+1), "x"},
+		{"ndc", strings.Repeat("v", maxAttributeValueLength+1)},
+	}
+	for _, attribute := range invalid {
+		err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			return contract.SetMedicineAttribute(ctx, "Aspirin", attribute.key, attribute.value)
+		})
+		if err == nil {
+			t.Errorf("SetMedicineAttribute accepted a key of %d and a value of %d bytes", len(attribute.key), len(attribute.value))
+		}
+	}
+	err = fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SetMedicineAttribute(ctx, "Aspirin", "ndc", "0000-0000")
+	})
+	if err == nil {
+		t.Errorf("a non-owner set an attribute")
+	}
+}
+
+func TestMedicineAttributesJSON(t *testing.T) {
+	var legacy Medicine
+	err := json.Unmarshal([]byte(`{"name":"Aspirin","quantity":1}`), &legacy)
+	if err != nil {
+		t.Fatalf("failed to unmarshal a record without attributes: %v", err)
+	}
+	if legacy.Attributes != nil {
+		t.Errorf("attributes of a record without the field = %v, want nil", legacy.Attributes)
+	}
+
+	medicine := Medicine{Name: "Aspirin", Attributes: map[string]string{"schedule": "II"}}
+	medicineJSON, err := json.Marshal(medicine)
+	if err != nil {
+		t.Fatalf("failed to marshal medicine: %v", err)
+	}
+	var decoded Medicine
+	err = json.Unmarshal(medicineJSON, &decoded)
+	if err != nil {
+		t.Fatalf("failed to unmarshal medicine: %v", err)
+	}
+	if decoded.Attributes["schedule"] != "II" {
+		t.Errorf("attributes after a round trip = %v, want schedule II", decoded.Attributes)
+	}
+}
+
+func TestReturnMedicineConservesQuantity(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SplitMedicine(ctx, "Aspirin", 6, "Aspirin P", pharmacyMSP)
+	})
+	if err != nil {
+		t.Fatalf("SplitMedicine failed: %v", err)
+	}
+
+	// The second return adds to the holding the first one opened
+	for _, quantity := range []int{2, 3} {
+		err = fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+			return contract.ReturnMedicine(ctx, "Aspirin P", quantity, producerMSP, "unsold")
+		})
+		if err != nil {
+			t.Fatalf("ReturnMedicine(%d) failed: %v", quantity, err)
+		}
+	}
+	if fake.lastEvent == nil || fake.lastEvent.Name != "MedicineReturned" {
+		t.Errorf("last event = %+v, want MedicineReturned", fake.lastEvent)
+	}
+
+	err = fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.ReturnMedicine(ctx, "Aspirin P", 2, producerMSP, "unsold")
+	})
+	if err == nil || !strings.Contains(err.Error(), "must be between 1 and 1") {
+		t.Errorf("ReturnMedicine error = %v, want a quantity error", err)
+	}
+
+	// The stock goes back into the lot it was split from
+	held := getTestMedicine(t, fake, "Aspirin P")
+	returned := getTestMedicine(t, fake, "Aspirin")
+	if held.Quantity != 1 || returned.Quantity != 9 {
+		t.Errorf("quantities after returns = %d held and %d returned, want 1 and 9", held.Quantity, returned.Quantity)
+	}
+	if held.Owner != pharmacyMSP || returned.Owner != producerMSP {
+		t.Errorf("owners after returns = %s and %s, want %s and %s", held.Owner, returned.Owner, pharmacyMSP, producerMSP)
+	}
+
+	var entries []*AuditEntry
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		entries, err = contract.GetAuditLog(ctx, "Aspirin P")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetAuditLog failed: %v", err)
+	}
+	reasons := 0
+	for _, entry := range entries {
+		if entry.Reason == "unsold" {
+			reasons++
+		}
+	}
+	if reasons != 2 {
+		t.Errorf("audit log has %d entries with the return reason, want 2", reasons)
+	}
+}
+
+func TestReturnMedicineOpensReturnLot(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SplitMedicine(ctx, "Aspirin", 6, "Aspirin S", supplierMSP)
+	})
+	if err != nil {
+		t.Fatalf("SplitMedicine failed: %v", err)
+	}
+	err = fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SplitMedicine(ctx, "Aspirin S", 4, "Aspirin P", pharmacyMSP)
+	})
+	if err != nil {
+		t.Fatalf("SplitMedicine failed: %v", err)
+	}
+
+	// The producer does not hold the lot the pharmacy's stock was split from,
+	// so the first return opens a lot and the second adds to it
+	for _, quantity := range []int{1, 2} {
+		err = fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+			return contract.ReturnMedicine(ctx, "Aspirin P", quantity, producerMSP, "unsold")
+		})
+		if err != nil {
+			t.Fatalf("ReturnMedicine(%d) failed: %v", quantity, err)
+		}
+	}
+
+	returned := getTestMedicine(t, fake, returnLotName("Aspirin P", producerMSP))
+	if returned.Quantity != 3 || returned.Owner != producerMSP || returned.SplitFrom != "Aspirin P" {
+		t.Errorf("return lot = %d owned by %s split from %q, want 3 owned by %s split from %q", returned.Quantity, returned.Owner, returned.SplitFrom, producerMSP, "Aspirin P")
+	}
+	if source := getTestMedicine(t, fake, "Aspirin"); source.Quantity != 4 {
+		t.Errorf("producer lot quantity = %d, want 4", source.Quantity)
+	}
+	if supplier := getTestMedicine(t, fake, "Aspirin S"); supplier.Quantity != 2 {
+		t.Errorf("supplier lot quantity = %d, want 2", supplier.Quantity)
+	}
+}
+
+func TestReturnMedicineRejectsExpiredStock(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicineExpiring(t, fake, producerMSP, "Aspirin", 10, "2026-03-01T00:00:00Z")
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SplitMedicine(ctx, "Aspirin", 6, "Aspirin P", pharmacyMSP)
+	})
+	if err != nil {
+		t.Fatalf("SplitMedicine failed: %v", err)
+	}
+
+	fake.clock = time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	err = fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.ReturnMedicine(ctx, "Aspirin P", 2, producerMSP, "unsold")
+	})
+	if err == nil || !strings.Contains(err.Error(), "cannot be transferred") {
+		t.Fatalf("ReturnMedicine error = %v, want an expiry error", err)
+	}
+
+	if held := getTestMedicine(t, fake, "Aspirin P"); held.Quantity != 6 {
+		t.Errorf("held quantity = %d, want 6", held.Quantity)
+	}
+}
+
+func TestDeleteMedicinesIsAtomic(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		wantErr string
+	}{
+		{name: "all valid", names: []string{"Aspirin", "Ibuprofen"}},
+		{name: "missing name", names: []string{"Aspirin", "Ibuprofen", "Missing"}, wantErr: "failed to delete medicine Missing"},
+		{name: "not the owner", names: []string{"Aspirin", "Zinc"}, wantErr: "failed to delete medicine Zinc"},
+		{name: "repeated name", names: []string{"Aspirin", "Aspirin"}, wantErr: "listed more than once"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			addTestMedicine(t, fake, producerMSP, "Ibuprofen", 10)
+			addTestMedicine(t, fake, supplierMSP, "Zinc", 10)
+
+			var deleted []string
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				deleted, err = contract.DeleteMedicines(ctx, tt.names)
+				return err
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("DeleteMedicines error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				// Nothing from the failed batch may be gone
+				getTestMedicine(t, fake, "Aspirin")
+				getTestMedicine(t, fake, "Ibuprofen")
+				return
+			}
+			if err != nil {
+				t.Fatalf("DeleteMedicines failed: %v", err)
+			}
+			if strings.Join(deleted, ",") != strings.Join(tt.names, ",") {
+				t.Errorf("DeleteMedicines = %v, want %v", deleted, tt.names)
+			}
+		})
+	}
+}
+
+func TestGetMedicineAtTimeAfterRemoval(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, producerMSP, "Zinc", 10)
+	beforeRemoval := fake.clock.Format(time.RFC3339)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.DeleteMedicine(ctx, "Aspirin")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("DeleteMedicine failed: %v", err)
+	}
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RenameMedicine(ctx, "Zinc", "Zinc Sulfate")
+	})
+	if err != nil {
+		t.Fatalf("RenameMedicine failed: %v", err)
+	}
+	afterRemoval := fake.clock.Add(time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		name         string
+		medicineName string
+		at           string
+		wantErr      bool
+	}{
+		{name: "before archiving", medicineName: "Aspirin", at: beforeRemoval},
+		{name: "after archiving", medicineName: "Aspirin", at: afterRemoval, wantErr: true},
+		{name: "before renaming", medicineName: "Zinc", at: beforeRemoval},
+		{name: "after renaming", medicineName: "Zinc", at: afterRemoval, wantErr: true},
+		{name: "renamed record", medicineName: "Zinc Sulfate", at: afterRemoval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var medicine *Medicine
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicine, err = contract.GetMedicineAtTime(ctx, tt.medicineName, tt.at)
+				return err
+			})
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrMedicineNotFound) {
+					t.Fatalf("GetMedicineAtTime error = %v, want %v", err, ErrMedicineNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetMedicineAtTime failed: %v", err)
+			}
+			if medicine.Name != tt.medicineName {
+				t.Errorf("GetMedicineAtTime returned %s, want %s", medicine.Name, tt.medicineName)
+			}
+		})
+	}
+}
+
+func TestUpsertMedicine(t *testing.T) {
+	tests := []struct {
+		name            string
+		caller          string
+		quantity        int
+		manufactureDate string
+		expiryDate      string
+		wantErr         string
+	}{
+		{name: "update", caller: producerMSP, quantity: 25, manufactureDate: testManufactureDate, expiryDate: "2028-01-01T00:00:00Z"},
+		{name: "retry with the same values", caller: producerMSP, quantity: 10, manufactureDate: testManufactureDate, expiryDate: testExpiryDate},
+		{name: "zero quantity", caller: producerMSP, quantity: 0, manufactureDate: testManufactureDate, expiryDate: testExpiryDate, wantErr: "quantity must be positive"},
+		{name: "expiry before manufacture", caller: producerMSP, quantity: 10, manufactureDate: "2028-06-01T00:00:00Z", expiryDate: "2028-01-01T00:00:00Z", wantErr: "must be before expiry date"},
+		{name: "shortened expiry", caller: producerMSP, quantity: 10, manufactureDate: testManufactureDate, expiryDate: "2026-06-01T00:00:00Z", wantErr: "must not be earlier than current expiry"},
+		{name: "not the owner", caller: supplierMSP, quantity: 10, manufactureDate: testManufactureDate, expiryDate: testExpiryDate, wantErr: "only the owner"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.AdjustQuantity(ctx, "Aspirin", -4)
+			})
+			if err != nil {
+				t.Fatalf("AdjustQuantity failed: %v", err)
+			}
+
+			err = fake.invoke(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.UpsertMedicine(ctx, "Aspirin", tt.quantity, tt.manufactureDate, tt.expiryDate)
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("UpsertMedicine error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UpsertMedicine failed: %v", err)
+			}
+
+			// The upserted quantity replaces the pending adjustment
+			var quantity int
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				quantity, err = contract.GetEffectiveQuantity(ctx, "Aspirin")
+				return err
+			})
+			if err != nil {
+				t.Fatalf("GetEffectiveQuantity failed: %v", err)
+			}
+			if quantity != tt.quantity {
+				t.Errorf("effective quantity = %d, want %d", quantity, tt.quantity)
+			}
+
+			medicine := getTestMedicine(t, fake, "Aspirin")
+			if medicine.Owner != producerMSP || medicine.ExpiryDate.Format(time.RFC3339) != tt.expiryDate {
+				t.Errorf("upserted medicine = %+v, want owner %s and expiry %s", medicine, producerMSP, tt.expiryDate)
+			}
+		})
+	}
+}
+
+func TestUpsertMedicineCreates(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+
+	err := fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.UpsertMedicine(ctx, "Aspirin", 10, testManufactureDate, testExpiryDate)
+	})
+	if err != nil {
+		t.Fatalf("UpsertMedicine failed: %v", err)
+	}
+
+	medicine := getTestMedicine(t, fake, "Aspirin")
+	if medicine.Quantity != 10 || medicine.Owner != supplierMSP || medicine.ID == "" {
+		t.Errorf("created medicine = %+v, want 10 units owned by %s with an ID", medicine, supplierMSP)
+	}
+
+	err = fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.UpsertMedicine(ctx, "Ibuprofen", 0, testManufactureDate, testExpiryDate)
+	})
+	if err == nil {
+		t.Errorf("UpsertMedicine created a medicine with a quantity of 0")
+	}
+}
+
+func TestUpsertMedicineRejectsRemovedRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		remove  func(ctx contractapi.TransactionContextInterface) error
+		wantErr string
+	}{
+		{
+			name: "archived",
+			remove: func(ctx contractapi.TransactionContextInterface) error {
+				_, err := new(PharmaChaincode).DeleteMedicine(ctx, "Aspirin")
+				return err
+			},
+			wantErr: "is archived",
+		},
+		{
+			name: "renamed",
+			remove: func(ctx contractapi.TransactionContextInterface) error {
+				return new(PharmaChaincode).RenameMedicine(ctx, "Aspirin", "Aspirin Forte")
+			},
+			wantErr: "was renamed to Aspirin Forte",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			err := fake.invoke(producerMSP, tt.remove)
+			if err != nil {
+				t.Fatalf("removing Aspirin failed: %v", err)
+			}
+
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.UpsertMedicine(ctx, "Aspirin", 20, testManufactureDate, testExpiryDate)
+			})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("UpsertMedicine error = %v, want it to contain %q", err, tt.wantErr)
+			}
+
+			// No owner index entry may point at the hidden record
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.ListMedicinesByOwnerIndexed(ctx, producerMSP)
+				return err
+			})
+			if err != nil {
+				t.Errorf("ListMedicinesByOwnerIndexed failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestListMedicinesByOwnerIndexedSkipsStaleEntries(t *testing.T) {
+	fake := newFakeLedger(t)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, supplierMSP, "Ibuprofen", 10)
+
+	// Entries for a medicine that no longer exists and for one owned by
+	// another organization
+	for _, name := range []string{"Purged", "Ibuprofen"} {
+		key, err := shim.CreateCompositeKey(ownerIndexObjectType, []string{producerMSP, name})
+		if err != nil {
+			t.Fatalf("failed to create index key: %v", err)
+		}
+		fake.state[key] = []byte{0x00}
+	}
+
+	var medicines []*Medicine
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		medicines, err = new(PharmaChaincode).ListMedicinesByOwnerIndexed(ctx, producerMSP)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ListMedicinesByOwnerIndexed failed: %v", err)
+	}
+	if len(medicines) != 1 || medicines[0].Name != "Aspirin" {
+		t.Errorf("ListMedicinesByOwnerIndexed = %+v, want only Aspirin", medicines)
+	}
+}
+
+func TestDeleteExpiredMedicinesKeepsRequestedStock(t *testing.T) {
+	originalTTL := requestTTL
+	requestTTL = 365 * 24 * time.Hour
+	t.Cleanup(func() { requestTTL = originalTTL })
+
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	for _, name := range []string{"Requested", "Unrequested"} {
+		err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			_, err := contract.AddMedicine(ctx, name, 10, testManufactureDate, "2026-06-01T00:00:00Z", "", "", false, "", 0)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("AddMedicine(%q) failed: %v", name, err)
+		}
+	}
+	err := fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.RequestMedicine(ctx, "Requested", "urgent", 5)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RequestMedicine failed: %v", err)
+	}
+	fake.clock = time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	var deleted []string
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		deleted, err = contract.DeleteExpiredMedicines(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("DeleteExpiredMedicines failed: %v", err)
+	}
+	if strings.Join(deleted, ",") != "Unrequested" {
+		t.Errorf("DeleteExpiredMedicines = %v, want only Unrequested", deleted)
+	}
+
+	var requests []*MedicineRequest
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		requests, err = contract.GetRequestsForMedicine(ctx, "Requested")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetRequestsForMedicine failed: %v", err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("requests for the kept medicine = %d, want 1", len(requests))
+	}
+	getTestMedicine(t, fake, "Requested")
+}
+
+// addControlledTestMedicine adds a controlled substance so serials can be registered
+func addControlledTestMedicine(t *testing.T, fake *fakeLedger, name string, quantity int) {
+	t.Helper()
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := new(PharmaChaincode).AddMedicine(ctx, name, quantity, testManufactureDate, testExpiryDate, "analgesic", "injection", true, "vial", 0)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("AddMedicine(%q) failed: %v", name, err)
+	}
+}
+
+func TestActiveSerialsNeverExceedQuantity(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addControlledTestMedicine(t, fake, "Morphine", 2)
+
+	register := func(serial string) error {
+		return fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			return contract.RegisterSerial(ctx, "Morphine", serial)
+		})
+	}
+	setStatus := func(serial string, status string) error {
+		return fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			return contract.UpdateSerialStatus(ctx, "Morphine", serial, status)
+		})
+	}
+
+	for _, serial := range []string{"S1", "S2"} {
+		if err := register(serial); err != nil {
+			t.Fatalf("RegisterSerial(%s) failed: %v", serial, err)
+		}
+	}
+	if err := register("S3"); err == nil {
+		t.Errorf("a third active serial was registered for a lot of 2")
+	}
+
+	// A dispensed unit frees its place, and reactivating it needs one again
+	if err := setStatus("S2", serialStatusDispensed); err != nil {
+		t.Fatalf("UpdateSerialStatus failed: %v", err)
+	}
+	if err := register("S3"); err != nil {
+		t.Fatalf("RegisterSerial(S3) after dispensing failed: %v", err)
+	}
+	if err := setStatus("S2", serialStatusActive); err == nil {
+		t.Errorf("a dispensed serial was reactivated beyond the lot quantity")
+	}
+
+	// Splitting off stock may not leave more active serials than units
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SplitMedicine(ctx, "Morphine", 1, "Morphine B", producerMSP)
+	})
+	if err == nil {
+		t.Errorf("a split left 2 active serials on a lot of 1")
+	}
+}
+
+func TestPurgeMedicineRemovesSerials(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addControlledTestMedicine(t, fake, "Morphine", 1)
+
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RegisterSerial(ctx, "Morphine", "S1")
+	})
+	if err != nil {
+		t.Fatalf("RegisterSerial failed: %v", err)
+	}
+	err = fake.invoke(regulatorMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.PurgeMedicine(ctx, "Morphine")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("PurgeMedicine failed: %v", err)
+	}
+
+	// A new lot under the purged name starts without the old units
+	addControlledTestMedicine(t, fake, "Morphine", 1)
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		units, err := contract.GetSerials(ctx, "Morphine")
+		if err != nil {
+			return err
+		}
+		if len(units) != 0 {
+			t.Errorf("new lot has %d serials from the purged one", len(units))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("GetSerials failed: %v", err)
+	}
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RegisterSerial(ctx, "Morphine", "S2")
+	})
+	if err != nil {
+		t.Errorf("RegisterSerial on the new lot failed: %v", err)
+	}
+}
+
+func TestDeleteMedicineWithOutstandingRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		wait    time.Duration
+		wantErr bool
+	}{
+		{name: "open request", wantErr: true},
+		{name: "expired request", wait: requestTTL + time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+			err := fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.RequestMedicine(ctx, "Aspirin", "urgent", 5)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("RequestMedicine failed: %v", err)
+			}
+			fake.clock = fake.clock.Add(tt.wait)
+
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.DeleteMedicine(ctx, "Aspirin")
+				return err
+			})
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "outstanding requests") {
+					t.Fatalf("DeleteMedicine error = %v, want an outstanding requests error", err)
+				}
+				getTestMedicine(t, fake, "Aspirin")
+				return
+			}
+			if err != nil {
+				t.Fatalf("DeleteMedicine failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestTwoStepTransfer(t *testing.T) {
+	tests := []struct {
+		name      string
+		finisher  string
+		finish    func(c *PharmaChaincode, ctx contractapi.TransactionContextInterface) error
+		wantOwner string
+		wantErr   string
+	}{
+		{
+			name:     "accept",
+			finisher: pharmacyMSP,
+			finish: func(c *PharmaChaincode, ctx contractapi.TransactionContextInterface) error {
+				return c.AcceptTransfer(ctx, "Aspirin")
+			},
+			wantOwner: pharmacyMSP,
+		},
+		{
+			name:     "cancel",
+			finisher: producerMSP,
+			finish: func(c *PharmaChaincode, ctx contractapi.TransactionContextInterface) error {
+				return c.CancelTransfer(ctx, "Aspirin")
+			},
+			wantOwner: producerMSP,
+		},
+		{
+			name:     "accept by another organization",
+			finisher: supplierMSP,
+			finish: func(c *PharmaChaincode, ctx contractapi.TransactionContextInterface) error {
+				return c.AcceptTransfer(ctx, "Aspirin")
+			},
+			wantErr: "only the pending owner PharmacyMSP may accept medicine Aspirin",
+		},
+		{
+			name:     "cancel by the receiver",
+			finisher: pharmacyMSP,
+			finish: func(c *PharmaChaincode, ctx contractapi.TransactionContextInterface) error {
+				return c.CancelTransfer(ctx, "Aspirin")
+			},
+			wantErr: "only the owner ProducerMSP may cancel",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.InitiateTransfer(ctx, "Aspirin", pharmacyMSP)
+			})
+			if err != nil {
+				t.Fatalf("InitiateTransfer failed: %v", err)
+			}
+			if pending := getTestMedicine(t, fake, "Aspirin"); pending.Owner != producerMSP || pending.PendingOwner != pharmacyMSP {
+				t.Fatalf("pending transfer = owner %s pending %s, want %s pending %s", pending.Owner, pending.PendingOwner, producerMSP, pharmacyMSP)
+			}
+
+			err = fake.invoke(tt.finisher, func(ctx contractapi.TransactionContextInterface) error {
+				return tt.finish(contract, ctx)
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if medicine := getTestMedicine(t, fake, "Aspirin"); medicine.PendingOwner != pharmacyMSP {
+					t.Errorf("a refused call changed the pending owner to %q", medicine.PendingOwner)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("finishing the transfer failed: %v", err)
+			}
+
+			medicine := getTestMedicine(t, fake, "Aspirin")
+			if medicine.Owner != tt.wantOwner || medicine.PendingOwner != "" {
+				t.Errorf("medicine = owner %s pending %q, want owner %s and no pending owner", medicine.Owner, medicine.PendingOwner, tt.wantOwner)
+			}
+		})
+	}
+}
+
+func TestValidateMedicineInput(t *testing.T) {
+	tests := []struct {
+		name            string
+		medicineName    string
+		quantity        int
+		manufactureDate string
+		expiryDate      string
+		wantReason      string
+	}{
+		{name: "valid", medicineName: "Paracetamol", quantity: 100, manufactureDate: testManufactureDate, expiryDate: testExpiryDate},
+		{name: "empty name", quantity: 100, manufactureDate: testManufactureDate, expiryDate: testExpiryDate, wantReason: "name must not be empty"},
+		{name: "zero quantity", medicineName: "Aspirin", manufactureDate: testManufactureDate, expiryDate: testExpiryDate, wantReason: "quantity must be positive"},
+		{name: "bad manufacture date", medicineName: "Aspirin", quantity: 1, manufactureDate: "2025-06-01", expiryDate: testExpiryDate, wantReason: "failed to parse manufacture date"},
+		{name: "bad expiry date", medicineName: "Aspirin", quantity: 1, manufactureDate: testManufactureDate, expiryDate: "June 2027", wantReason: "failed to parse expiry date"},
+		{name: "expiry before manufacture", medicineName: "Aspirin", quantity: 1, manufactureDate: testExpiryDate, expiryDate: testManufactureDate, wantReason: "must be before expiry date"},
+		{name: "duplicate", medicineName: "Existing", quantity: 1, manufactureDate: testManufactureDate, expiryDate: testExpiryDate, wantReason: ErrMedicineExists.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Existing", 10)
+			stateSize := len(fake.state)
+
+			var result *ValidationResult
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				result, err = new(PharmaChaincode).ValidateMedicineInput(ctx, tt.medicineName, tt.quantity, tt.manufactureDate, tt.expiryDate)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("ValidateMedicineInput failed: %v", err)
+			}
+
+			if tt.wantReason == "" {
+				if !result.Valid || result.Reason != "" {
+					t.Errorf("ValidateMedicineInput = %+v, want a valid result", result)
+				}
+			} else if result.Valid || !strings.Contains(result.Reason, tt.wantReason) {
+				t.Errorf("ValidateMedicineInput = %+v, want an invalid result with a reason containing %q", result, tt.wantReason)
+			}
+
+			// Validation is a dry run
+			if len(fake.state) != stateSize {
+				t.Errorf("ValidateMedicineInput wrote %d keys", len(fake.state)-stateSize)
+			}
+		})
+	}
+}
+
+// ValidateMedicineInput is the dry run of AddMedicine: for any input it must
+// reject exactly what AddMedicine rejects, for the same reason
+func TestValidateMedicineInputPredictsAddMedicine(t *testing.T) {
+	tests := []struct {
+		name            string
+		medicineName    string
+		quantity        int
+		manufactureDate string
+		expiryDate      string
+	}{
+		{name: "valid", medicineName: "Paracetamol", quantity: 100, manufactureDate: testManufactureDate, expiryDate: testExpiryDate},
+		{name: "invalid name", medicineName: "Para\x00cetamol", quantity: 100, manufactureDate: testManufactureDate, expiryDate: testExpiryDate},
+		{name: "negative quantity", medicineName: "Paracetamol", quantity: -1, manufactureDate: testManufactureDate, expiryDate: testExpiryDate},
+		{name: "bad date", medicineName: "Paracetamol", quantity: 1, manufactureDate: testManufactureDate, expiryDate: "2027-13-01T00:00:00Z"},
+		{name: "duplicate", medicineName: "Existing", quantity: 1, manufactureDate: testManufactureDate, expiryDate: testExpiryDate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Existing", 10)
+
+			var result *ValidationResult
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				result, err = contract.ValidateMedicineInput(ctx, tt.medicineName, tt.quantity, tt.manufactureDate, tt.expiryDate)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("ValidateMedicineInput failed: %v", err)
+			}
+
+			addErr := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.AddMedicine(ctx, tt.medicineName, tt.quantity, tt.manufactureDate, tt.expiryDate, "", "", false, "", 0)
+				return err
+			})
+
+			if result.Valid != (addErr == nil) {
+				t.Fatalf("ValidateMedicineInput = %+v but AddMedicine error = %v", result, addErr)
+			}
+			if addErr != nil && !strings.Contains(addErr.Error(), result.Reason) {
+				t.Errorf("ValidateMedicineInput reason %q does not match AddMedicine error %q", result.Reason, addErr)
+			}
+		})
+	}
+}
+
+func TestTransferAllMedicines(t *testing.T) {
+	tests := []struct {
+		name     string
+		newOwner string
+		wantErr  string
+	}{
+		{name: "to another organization", newOwner: pharmacyMSP},
+		{name: "to itself", newOwner: producerMSP, wantErr: "must be a different organization"},
+		{name: "to an empty owner", newOwner: "", wantErr: "must be a different organization"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			addTestMedicine(t, fake, producerMSP, "Ibuprofen", 10)
+
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return new(PharmaChaincode).TransferAllMedicines(ctx, tt.newOwner)
+			})
+
+			wantOwner := tt.newOwner
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("TransferAllMedicines error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				wantOwner = producerMSP
+			} else if err != nil {
+				t.Fatalf("TransferAllMedicines failed: %v", err)
+			}
+
+			for _, name := range []string{"Aspirin", "Ibuprofen"} {
+				if medicine := getTestMedicine(t, fake, name); medicine.Owner != wantOwner {
+					t.Errorf("owner of %s = %q, want %q", name, medicine.Owner, wantOwner)
+				}
+			}
+		})
+	}
+}
+
+// addTestMedicineExpiring adds a medicine like addTestMedicine with the given
+// expiry date
+func addTestMedicineExpiring(t *testing.T, fake *fakeLedger, org string, name string, quantity int, expiryDate string) {
+	t.Helper()
+
+	err := fake.invoke(org, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := new(PharmaChaincode).AddMedicine(ctx, name, quantity, testManufactureDate, expiryDate, "analgesic", "tablet", false, "tablet", 0)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("AddMedicine(%q) failed: %v", name, err)
+	}
+}
+
+func TestGetExpiryStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiryDate string
+		want       string
+	}{
+		{name: "far from expiry", expiryDate: testExpiryDate, want: "ok"},
+		{name: "within the window", expiryDate: "2026-02-15T00:00:00Z", want: "expiring_soon"},
+		{name: "past expiry", expiryDate: "2026-01-15T00:00:00Z", want: "expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicineExpiring(t, fake, producerMSP, "Aspirin", 10, tt.expiryDate)
+			fake.clock = time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+
+			var status string
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				status, err = new(PharmaChaincode).GetExpiryStatus(ctx, "Aspirin")
+				return err
+			})
+			if err != nil {
+				t.Fatalf("GetExpiryStatus failed: %v", err)
+			}
+			if status != tt.want {
+				t.Errorf("GetExpiryStatus = %q, want %q", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestMedicineIDIsStableAcrossUpdates(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	added := addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	updates := []func(ctx contractapi.TransactionContextInterface) error{
+		func(ctx contractapi.TransactionContextInterface) error {
+			return contract.RestockMedicine(ctx, "Aspirin", 5)
+		},
+		func(ctx contractapi.TransactionContextInterface) error {
+			return contract.SetMedicineAttribute(ctx, "Aspirin", "ndc", "0000-0000")
+		},
+		func(ctx contractapi.TransactionContextInterface) error {
+			return contract.UpsertMedicine(ctx, "Aspirin", 20, testManufactureDate, testExpiryDate)
+		},
+	}
+	for i, update := range updates {
+		err := fake.invoke(producerMSP, update)
+		if err != nil {
+			t.Fatalf("update %d failed: %v", i, err)
+		}
+		if medicine := getTestMedicine(t, fake, "Aspirin"); medicine.ID != added.ID {
+			t.Fatalf("ID after update %d = %s, want %s", i, medicine.ID, added.ID)
+		}
+	}
+
+	// Renaming keeps the ID with the record under its new name
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.RenameMedicine(ctx, "Aspirin", "Aspirin Forte")
+	})
+	if err != nil {
+		t.Fatalf("RenameMedicine failed: %v", err)
+	}
+	var byID *Medicine
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		byID, err = contract.GetMedicineByID(ctx, added.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetMedicineByID failed: %v", err)
+	}
+	if byID.Name != "Aspirin Forte" || byID.Quantity != 20 {
+		t.Errorf("GetMedicineByID = %s with %d units, want Aspirin Forte with 20", byID.Name, byID.Quantity)
+	}
+}
+
+func TestGetTotalQuantity(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, producerMSP, "Archived", 10)
+
+	// Two lots indexed under one name
+	for _, lot := range []Medicine{
+		{ID: "lot-1", Name: "Amoxicillin", Quantity: 4, Owner: producerMSP},
+		{ID: "lot-2", Name: "Amoxicillin", Quantity: 6, Owner: supplierMSP},
+	} {
+		lotJSON, err := json.Marshal(lot)
+		if err != nil {
+			t.Fatalf("failed to marshal lot: %v", err)
+		}
+		fake.state[lot.ID] = lotJSON
+
+		key, err := shim.CreateCompositeKey(nameIndexObjectType, []string{lot.Name, lot.ID})
+		if err != nil {
+			t.Fatalf("failed to create index key: %v", err)
+		}
+		fake.state[key] = []byte{0x00}
+	}
+
+	// Units taken by a pending adjustment are no longer available
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.AdjustQuantity(ctx, "Aspirin", -3)
+	})
+	if err != nil {
+		t.Fatalf("AdjustQuantity failed: %v", err)
+	}
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := contract.DeleteMedicine(ctx, "Archived")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("DeleteMedicine failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want int
+	}{
+		{name: "Amoxicillin", want: 10},
+		{name: "Aspirin", want: 7},
+		{name: "Archived", want: 0},
+		{name: "Unknown", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var total int
+			err := fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				total, err = contract.GetTotalQuantity(ctx, tt.name)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("GetTotalQuantity failed: %v", err)
+			}
+			if total != tt.want {
+				t.Errorf("GetTotalQuantity(%q) = %d, want %d", tt.name, total, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveMedicineKey(t *testing.T) {
+	fake := newFakeLedger(t)
+	added := addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+	// A record from before IDs existed: keyed by name and not indexed
+	legacyJSON, err := json.Marshal(Medicine{Name: "Legacy", Quantity: 1, Owner: producerMSP})
+	if err != nil {
+		t.Fatalf("failed to marshal legacy medicine: %v", err)
+	}
+	fake.state["Legacy"] = legacyJSON
+
+	// Two index entries for one name are a corrupt index
+	for _, id := range []string{"id-1", "id-2"} {
+		key, err := shim.CreateCompositeKey(nameIndexObjectType, []string{"Twice", id})
+		if err != nil {
+			t.Fatalf("failed to create index key: %v", err)
+		}
+		fake.state[key] = []byte{0x00}
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr string
+	}{
+		{name: "Aspirin", want: added.ID},
+		{name: "Legacy", want: "Legacy"},
+		{name: "Unknown", want: "Unknown"},
+		{name: "Twice", wantErr: "maps to 2 IDs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var key string
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				key, err = resolveMedicineKey(ctx, tt.name)
+				return err
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveMedicineKey error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveMedicineKey failed: %v", err)
+			}
+			if key != tt.want {
+				t.Errorf("resolveMedicineKey(%q) = %q, want %q", tt.name, key, tt.want)
+			}
+		})
+	}
+
+	if legacy := getTestMedicine(t, fake, "Legacy"); legacy.Quantity != 1 {
+		t.Errorf("legacy medicine quantity = %d, want 1", legacy.Quantity)
+	}
+}
+
+func TestQueryMedicinesByOwnerSelector(t *testing.T) {
+	fake := newFakeLedger(t)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, pharmacyMSP, "Ibuprofen", 10)
+
+	tests := []struct {
+		name      string
+		owner     string
+		wantNames string
+	}{
+		{name: "producer", owner: producerMSP, wantNames: "Aspirin"},
+		{name: "pharmacy", owner: pharmacyMSP, wantNames: "Ibuprofen"},
+		{name: "quotes and braces", owner: `ProducerMSP"},"owner":{"$gt":""}}`, wantNames: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryString, err := buildSelector("owner", tt.owner)
+			if err != nil {
+				t.Fatalf("buildSelector failed: %v", err)
+			}
+
+			// The value must come back out of the selector unchanged
+			var query struct {
+				Selector map[string]string `json:"selector"`
+			}
+			err = json.Unmarshal([]byte(queryString), &query)
+			if err != nil {
+				t.Fatalf("buildSelector produced invalid JSON %s: %v", queryString, err)
+			}
+			if len(query.Selector) != 1 || query.Selector["owner"] != tt.owner {
+				t.Fatalf("buildSelector selector = %v, want only owner %q", query.Selector, tt.owner)
+			}
+
+			var medicines []*Medicine
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicines, err = new(PharmaChaincode).QueryMedicinesByOwner(ctx, tt.owner)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("QueryMedicinesByOwner failed: %v", err)
+			}
+
+			var names []string
+			for _, medicine := range medicines {
+				names = append(names, medicine.Name)
+			}
+			if strings.Join(names, ",") != tt.wantNames {
+				t.Errorf("QueryMedicinesByOwner(%q) = %v, want %s", tt.owner, names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestGetOwners(t *testing.T) {
+	fake := newFakeLedger(t)
+	addTestMedicine(t, fake, supplierMSP, "Zinc", 10)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, producerMSP, "Ibuprofen", 10)
+
+	var owners []string
+	err := fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		owners, err = new(PharmaChaincode).GetOwners(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetOwners failed: %v", err)
+	}
+
+	// Each owner is listed once, in sorted order
+	if strings.Join(owners, ",") != producerMSP+","+supplierMSP {
+		t.Errorf("GetOwners = %v, want [%s %s]", owners, producerMSP, supplierMSP)
+	}
+}
+
+func TestTransferAllFromOwner(t *testing.T) {
+	tests := []struct {
+		name      string
+		caller    string
+		wantCount int
+		wantErr   string
+	}{
+		{name: "by the owner", caller: producerMSP, wantCount: 2},
+		{name: "by a regulator", caller: regulatorMSP, wantCount: 2},
+		{name: "by another organization", caller: supplierMSP, wantErr: "only ProducerMSP or a regulator"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			addTestMedicine(t, fake, producerMSP, "Ibuprofen", 10)
+			addTestMedicine(t, fake, supplierMSP, "Zinc", 10)
+
+			var count int
+			err := fake.invoke(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				count, err = new(PharmaChaincode).TransferAllFromOwner(ctx, producerMSP, pharmacyMSP)
+				return err
+			})
+
+			wantOwners := map[string]string{"Aspirin": pharmacyMSP, "Ibuprofen": pharmacyMSP, "Zinc": supplierMSP}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("TransferAllFromOwner error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				wantOwners["Aspirin"] = producerMSP
+				wantOwners["Ibuprofen"] = producerMSP
+			} else if err != nil {
+				t.Fatalf("TransferAllFromOwner failed: %v", err)
+			} else if count != tt.wantCount {
+				t.Errorf("TransferAllFromOwner = %d, want %d", count, tt.wantCount)
+			}
+
+			for name, wantOwner := range wantOwners {
+				if medicine := getTestMedicine(t, fake, name); medicine.Owner != wantOwner {
+					t.Errorf("owner of %s = %q, want %q", name, medicine.Owner, wantOwner)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchMedicinesIntersectsFilters(t *testing.T) {
+	fake := newFakeLedger(t)
+	for _, lot := range []struct {
+		org, name, category, expiryDate string
+		quantity                        int
+	}{
+		{producerMSP, "Aspirin", "analgesic", testExpiryDate, 10},
+		{producerMSP, "Ibuprofen", "analgesic", "2026-09-01T00:00:00Z", 50},
+		{producerMSP, "Amoxicillin", "antibiotic", testExpiryDate, 50},
+		{supplierMSP, "Zinc", "analgesic", "2026-09-01T00:00:00Z", 50},
+	} {
+		err := fake.invoke(lot.org, func(ctx contractapi.TransactionContextInterface) error {
+			_, err := new(PharmaChaincode).AddMedicine(ctx, lot.name, lot.quantity, testManufactureDate, lot.expiryDate, lot.category, "tablet", false, "tablet", 0)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("AddMedicine(%q) failed: %v", lot.name, err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		filter    string
+		wantNames string
+	}{
+		{name: "owner and category", filter: `{"owner":"ProducerMSP","category":"analgesic"}`, wantNames: "Aspirin,Ibuprofen"},
+		{name: "owner and minimum quantity", filter: `{"owner":"ProducerMSP","minQuantity":20}`, wantNames: "Amoxicillin,Ibuprofen"},
+		{name: "category and expiry", filter: `{"category":"analgesic","expiringBeforeRFC3339":"2027-01-01T00:00:00Z"}`, wantNames: "Ibuprofen,Zinc"},
+		{name: "no overlap", filter: `{"owner":"SupplierMSP","category":"antibiotic"}`, wantNames: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var medicines []*Medicine
+			err := fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicines, err = new(PharmaChaincode).SearchMedicines(ctx, tt.filter)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("SearchMedicines failed: %v", err)
+			}
+
+			var names []string
+			for _, medicine := range medicines {
+				names = append(names, medicine.Name)
+			}
+			if strings.Join(names, ",") != tt.wantNames {
+				t.Errorf("SearchMedicines(%s) = %v, want %s", tt.filter, names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestExtendExpiry(t *testing.T) {
+	tests := []struct {
+		name      string
+		caller    string
+		newExpiry string
+		wantErr   string
+	}{
+		{name: "later date", caller: producerMSP, newExpiry: "2028-06-01T00:00:00Z"},
+		{name: "by a regulator", caller: regulatorMSP, newExpiry: "2028-06-01T00:00:00Z"},
+		{name: "earlier date", caller: producerMSP, newExpiry: "2026-06-01T00:00:00Z", wantErr: "must be later than current expiry"},
+		{name: "same date", caller: producerMSP, newExpiry: testExpiryDate, wantErr: "must be later than current expiry"},
+		{name: "not the owner", caller: supplierMSP, newExpiry: "2028-06-01T00:00:00Z", wantErr: "only the owner"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+			err := fake.invoke(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+				return new(PharmaChaincode).ExtendExpiry(ctx, "Aspirin", tt.newExpiry)
+			})
+
+			wantExpiry := tt.newExpiry
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ExtendExpiry error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				wantExpiry = testExpiryDate
+			} else if err != nil {
+				t.Fatalf("ExtendExpiry failed: %v", err)
+			}
+
+			if medicine := getTestMedicine(t, fake, "Aspirin"); medicine.ExpiryDate.Format(time.RFC3339) != wantExpiry {
+				t.Errorf("expiry = %s, want %s", medicine.ExpiryDate.Format(time.RFC3339), wantExpiry)
+			}
+		})
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	fake := newFakeLedger(t)
+
+	var mspID string
+	err := fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		mspID, err = new(PharmaChaincode).WhoAmI(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WhoAmI failed: %v", err)
+	}
+	if mspID != pharmacyMSP {
+		t.Errorf("WhoAmI = %q, want %q", mspID, pharmacyMSP)
+	}
+}
+
+func TestEmptyMSPIDIsRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(ctx contractapi.TransactionContextInterface) error
+	}{
+		{
+			name: "AddMedicine",
+			call: func(ctx contractapi.TransactionContextInterface) error {
+				_, err := new(PharmaChaincode).AddMedicine(ctx, "Ibuprofen", 10, testManufactureDate, testExpiryDate, "", "", false, "", 0)
+				return err
+			},
+		},
+		{
+			name: "RequestMedicine",
+			call: func(ctx contractapi.TransactionContextInterface) error {
+				_, err := new(PharmaChaincode).RequestMedicine(ctx, "Aspirin", "urgent", 5)
+				return err
+			},
+		},
+		{
+			name: "InitiateTransfer",
+			call: func(ctx contractapi.TransactionContextInterface) error {
+				return new(PharmaChaincode).InitiateTransfer(ctx, "Aspirin", pharmacyMSP)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+			err := fake.invoke("", tt.call)
+			if err == nil || !strings.Contains(err.Error(), "could not determine caller organization") {
+				t.Fatalf("%s error = %v, want it to contain %q", tt.name, err, "could not determine caller organization")
+			}
+
+			var medicines []*Medicine
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicines, err = new(PharmaChaincode).ListMedicines(ctx)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("ListMedicines failed: %v", err)
+			}
+			if len(medicines) != 1 || medicines[0].Owner != producerMSP || medicines[0].PendingOwner != "" {
+				t.Errorf("medicines after the rejected call = %+v, want only Aspirin unchanged", medicines)
+			}
+		})
+	}
+}
+
+func TestGetExpiringSoonByOwner(t *testing.T) {
+	tests := []struct {
+		name      string
+		caller    string
+		owner     string
+		wantNames []string
+	}{
+		{name: "named owner sorted by expiry", caller: pharmacyMSP, owner: producerMSP, wantNames: []string{"Early", "Late"}},
+		{name: "other owner excluded", caller: producerMSP, owner: supplierMSP, wantNames: []string{"Zinc"}},
+		{name: "empty owner is the caller", caller: producerMSP, wantNames: []string{"Early", "Late"}},
+		{name: "empty owner for another caller", caller: supplierMSP, wantNames: []string{"Zinc"}},
+		{name: "owner with no stock", caller: producerMSP, owner: pharmacyMSP, wantNames: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			addTestMedicineExpiring(t, fake, producerMSP, "Late", 10, "2026-06-01T00:00:00Z")
+			addTestMedicineExpiring(t, fake, producerMSP, "Early", 10, "2026-03-01T00:00:00Z")
+			addTestMedicineExpiring(t, fake, producerMSP, "Expired", 10, "2026-02-01T00:00:00Z")
+			addTestMedicineExpiring(t, fake, producerMSP, "Beyond", 10, "2027-06-01T00:00:00Z")
+			addTestMedicineExpiring(t, fake, supplierMSP, "Zinc", 10, "2026-04-01T00:00:00Z")
+			fake.clock = time.Date(2026, 2, 15, 0, 0, 0, 0, time.UTC)
+
+			var medicines []*Medicine
+			err := fake.invoke(tt.caller, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicines, err = new(PharmaChaincode).GetExpiringSoonByOwner(ctx, tt.owner, "2026-12-01T00:00:00Z")
+				return err
+			})
+			if err != nil {
+				t.Fatalf("GetExpiringSoonByOwner failed: %v", err)
+			}
+
+			names := []string{}
+			for _, medicine := range medicines {
+				names = append(names, medicine.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Errorf("GetExpiringSoonByOwner names = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestGetExpiryBuckets(t *testing.T) {
+	fake := newFakeLedger(t)
+	addTestMedicineExpiring(t, fake, producerMSP, "Expired", 1, "2026-01-15T00:00:00Z")
+	addTestMedicineExpiring(t, fake, producerMSP, "Near", 2, "2026-02-15T00:00:00Z")
+	addTestMedicineExpiring(t, fake, supplierMSP, "Mid", 3, "2026-04-01T00:00:00Z")
+	addTestMedicineExpiring(t, fake, supplierMSP, "Far", 4, testExpiryDate)
+	fake.clock = time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	var buckets *ExpiryBuckets
+	err := fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		buckets, err = new(PharmaChaincode).GetExpiryBuckets(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetExpiryBuckets failed: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		bucket       ExpiryBucket
+		wantQuantity int
+	}{
+		{name: "expired", bucket: buckets.Expired, wantQuantity: 1},
+		{name: "within 30 days", bucket: buckets.Within30Days, wantQuantity: 2},
+		{name: "within 90 days", bucket: buckets.Within90Days, wantQuantity: 3},
+		{name: "beyond 90 days", bucket: buckets.Beyond90Days, wantQuantity: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.bucket.Count != 1 || tt.bucket.QuantityByUnit["tablet"] != tt.wantQuantity {
+				t.Errorf("bucket = %d medicines with %v, want 1 medicine with %d tablets", tt.bucket.Count, tt.bucket.QuantityByUnit, tt.wantQuantity)
+			}
+		})
+	}
+}
+
+func TestGetMedicinesModifiedSince(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, producerMSP, "Ibuprofen", 10)
+	ibuprofenModified := getTestMedicine(t, fake, "Ibuprofen").LastModifiedAt
+
+	fake.clock = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SetMinStockLevel(ctx, "Aspirin", 5)
+	})
+	if err != nil {
+		t.Fatalf("SetMinStockLevel failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		since     string
+		wantNames string
+		wantErr   string
+	}{
+		{name: "before both", since: "2026-01-01T00:00:00Z", wantNames: "Ibuprofen,Aspirin"},
+		{name: "at the cutoff", since: ibuprofenModified.Format(time.RFC3339), wantNames: "Ibuprofen,Aspirin"},
+		{name: "after the first", since: "2026-02-01T00:00:00Z", wantNames: "Aspirin"},
+		{name: "in the future", since: "2027-01-01T00:00:00Z", wantErr: "is after the transaction time"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var medicines []*Medicine
+			err := fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicines, err = contract.GetMedicinesModifiedSince(ctx, tt.since)
+				return err
+			})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("GetMedicinesModifiedSince error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetMedicinesModifiedSince failed: %v", err)
+			}
+
+			var names []string
+			for _, medicine := range medicines {
+				names = append(names, medicine.Name)
+			}
+			if strings.Join(names, ",") != tt.wantNames {
+				t.Errorf("GetMedicinesModifiedSince(%s) = %v, want %s", tt.since, names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestLowStockReports(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	for _, lot := range []struct {
+		name      string
+		threshold int
+	}{{"Above", 5}, {"At", 10}, {"Below", 15}} {
+		addTestMedicine(t, fake, producerMSP, lot.name, 10)
+		err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			return contract.SetThreshold(ctx, lot.name, lot.threshold)
+		})
+		if err != nil {
+			t.Fatalf("SetThreshold(%q) failed: %v", lot.name, err)
+		}
+	}
+
+	// Stock at its level is due for reorder but not yet short
+	tests := []struct {
+		name      string
+		report    func(contractapi.TransactionContextInterface) ([]*Medicine, error)
+		wantNames string
+	}{
+		{name: "ListMedicinesBelowThreshold", report: contract.ListMedicinesBelowThreshold, wantNames: "At,Below"},
+		{name: "GetLowStockMedicines", report: contract.GetLowStockMedicines, wantNames: "Below"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var medicines []*Medicine
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				medicines, err = tt.report(ctx)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("%s failed: %v", tt.name, err)
+			}
+
+			var names []string
+			for _, medicine := range medicines {
+				names = append(names, medicine.Name)
+			}
+			if strings.Join(names, ",") != tt.wantNames {
+				t.Errorf("%s = %v, want %s", tt.name, names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestThresholdCrossingReportsLowStock(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SetThreshold(ctx, "Aspirin", 5)
+	})
+	if err != nil {
+		t.Fatalf("SetThreshold failed: %v", err)
+	}
+
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.AdjustQuantity(ctx, "Aspirin", -6)
+	})
+	if err != nil {
+		t.Fatalf("AdjustQuantity failed: %v", err)
+	}
+	if fake.lastEvent == nil || fake.lastEvent.Name != "LowStock" {
+		t.Errorf("last event = %+v, want LowStock", fake.lastEvent)
+	}
+
+	var medicines []*Medicine
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		medicines, err = contract.GetLowStockMedicines(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetLowStockMedicines failed: %v", err)
+	}
+	if len(medicines) != 1 || medicines[0].Name != "Aspirin" {
+		t.Errorf("GetLowStockMedicines = %+v, want only Aspirin", medicines)
+	}
+}
+
+func TestMedicinesByCategory(t *testing.T) {
+	fake := newFakeLedger(t)
+	addTestMedicine(t, fake, producerMSP, "Ibuprofen", 10)
+	addTestMedicine(t, fake, supplierMSP, "Aspirin", 10)
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		_, err := new(PharmaChaincode).AddMedicine(ctx, "Amoxicillin", 10, testManufactureDate, testExpiryDate, "antibiotic", "capsule", false, "capsule", 0)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("AddMedicine failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		category string
+		wantJSON string
+	}{
+		{name: "matching category", category: "analgesic", wantJSON: `["Aspirin","Ibuprofen"]`},
+		{name: "unknown category", category: "antiviral", wantJSON: `[]`},
+	}
+
+	// The scan and the rich query must agree
+	contract := new(PharmaChaincode)
+	methods := []struct {
+		name  string
+		query func(contractapi.TransactionContextInterface, string) ([]*Medicine, error)
+	}{
+		{name: "ListMedicinesByCategory", query: contract.ListMedicinesByCategory},
+		{name: "QueryMedicinesByCategory", query: contract.QueryMedicinesByCategory},
+	}
+
+	for _, tt := range tests {
+		for _, method := range methods {
+			t.Run(tt.name+" with "+method.name, func(t *testing.T) {
+				var medicines []*Medicine
+				err := fake.invoke(pharmacyMSP, func(ctx contractapi.TransactionContextInterface) error {
+					var err error
+					medicines, err = method.query(ctx, tt.category)
+					return err
+				})
+				if err != nil {
+					t.Fatalf("%s failed: %v", method.name, err)
+				}
+
+				// Clients expect an array, never null
+				if medicines == nil {
+					t.Fatalf("%s returned nil", method.name)
+				}
+				names := []string{}
+				for _, medicine := range medicines {
+					names = append(names, medicine.Name)
+				}
+				namesJSON, err := json.Marshal(names)
+				if err != nil {
+					t.Fatalf("failed to marshal names: %v", err)
+				}
+				if string(namesJSON) != tt.wantJSON {
+					t.Errorf("%s(%q) = %s, want %s", method.name, tt.category, namesJSON, tt.wantJSON)
+				}
+			})
+		}
+	}
+}
+
+func TestSetAllowedRequesters(t *testing.T) {
+	tests := []struct {
+		name       string
+		setter     string
+		orgs       string
+		wantSetErr string
+		requester  string
+		wantErr    string
+	}{
+		{name: "default allows supplier", requester: supplierMSP},
+		{name: "default excludes pharmacy", requester: pharmacyMSP, wantErr: "not allowed to make requests"},
+		{name: "added org may request", setter: regulatorMSP, orgs: `["SupplierMSP","PharmacyMSP"]`, requester: pharmacyMSP},
+		{name: "replaced list drops org", setter: regulatorMSP, orgs: `["PharmacyMSP"]`, requester: supplierMSP, wantErr: "not allowed to make requests"},
+		{name: "non-regulator rejected", setter: producerMSP, orgs: `["PharmacyMSP"]`, wantSetErr: "only RegulatorMSP may set the allowed requesters", requester: pharmacyMSP, wantErr: "not allowed to make requests"},
+		{name: "empty org rejected", setter: regulatorMSP, orgs: `["PharmacyMSP",""]`, wantSetErr: "must not be empty", requester: supplierMSP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+			// Without a stored list the hardcoded default applies
+			if tt.setter != "" {
+				err := fake.invoke(tt.setter, func(ctx contractapi.TransactionContextInterface) error {
+					return contract.SetAllowedRequesters(ctx, tt.orgs)
+				})
+				if tt.wantSetErr == "" && err != nil {
+					t.Fatalf("SetAllowedRequesters failed: %v", err)
+				}
+				if tt.wantSetErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantSetErr)) {
+					t.Fatalf("SetAllowedRequesters error = %v, want it to contain %q", err, tt.wantSetErr)
+				}
+			}
+
+			err := fake.invoke(tt.requester, func(ctx contractapi.TransactionContextInterface) error {
+				_, err := contract.RequestMedicine(ctx, "Aspirin", "restock", 2)
+				return err
+			})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("RequestMedicine as %s failed: %v", tt.requester, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("RequestMedicine as %s error = %v, want it to contain %q", tt.requester, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetRequestsForMedicine(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, producerMSP, "Ibuprofen", 10)
+
+	for _, request := range []struct{ org, name string }{
+		{producerMSP, "Aspirin"},
+		{supplierMSP, "Aspirin"},
+		{supplierMSP, "Ibuprofen"},
+	} {
+		err := fake.invoke(request.org, func(ctx contractapi.TransactionContextInterface) error {
+			_, err := contract.RequestMedicine(ctx, request.name, "restock", 2)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("RequestMedicine(%q) as %s failed: %v", request.name, request.org, err)
+		}
+	}
+
+	var requests []*MedicineRequest
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		requests, err = contract.GetRequestsForMedicine(ctx, "Aspirin")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetRequestsForMedicine failed: %v", err)
+	}
+
+	var requesters []string
+	for _, request := range requests {
+		if request.MedicineName != "Aspirin" {
+			t.Errorf("GetRequestsForMedicine returned a request for %s", request.MedicineName)
+		}
+		requesters = append(requesters, request.Requester)
+	}
+	sort.Strings(requesters)
+	if strings.Join(requesters, ",") != producerMSP+","+supplierMSP {
+		t.Errorf("requesters = %v, want [%s %s]", requesters, producerMSP, supplierMSP)
+	}
+}
+
+func TestRequestsExpireAtTransactionTime(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	addTestMedicine(t, fake, producerMSP, "Ibuprofen", 10)
+
+	requestMedicine := func(name string) *MedicineRequest {
+		t.Helper()
+
+		var request *MedicineRequest
+		err := fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+			var err error
+			request, err = contract.RequestMedicine(ctx, name, "restock", 2)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("RequestMedicine(%q) failed: %v", name, err)
+		}
+		return request
+	}
+	stale := requestMedicine("Aspirin")
+	fake.clock = fake.clock.Add(requestTTL / 2)
+	fresh := requestMedicine("Ibuprofen")
+
+	// The fake stamps each transaction a minute after the clock, so the next
+	// one is past the first request's expiry only
+	fake.clock = stale.ExpiresAt
+
+	listRequestIDs := func() string {
+		t.Helper()
+
+		var requests []*MedicineRequest
+		err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+			var err error
+			requests, err = contract.ListRequests(ctx)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("ListRequests failed: %v", err)
+		}
+
+		var ids []string
+		for _, request := range requests {
+			ids = append(ids, request.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+	if ids := listRequestIDs(); ids != fresh.ID {
+		t.Errorf("ListRequests = %s, want only %s", ids, fresh.ID)
+	}
+
+	var purged []string
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		purged, err = contract.PurgeExpiredRequests(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("PurgeExpiredRequests failed: %v", err)
+	}
+	if strings.Join(purged, ",") != stale.ID {
+		t.Errorf("PurgeExpiredRequests = %v, want only %s", purged, stale.ID)
+	}
+
+	// Once the second request expires as well it is the only one left to purge
+	fake.clock = fresh.ExpiresAt
+	if ids := listRequestIDs(); ids != "" {
+		t.Errorf("ListRequests after both expired = %s, want none", ids)
+	}
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		var err error
+		purged, err = contract.PurgeExpiredRequests(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("PurgeExpiredRequests failed: %v", err)
+	}
+	if strings.Join(purged, ",") != fresh.ID {
+		t.Errorf("PurgeExpiredRequests = %v, want only %s", purged, fresh.ID)
+	}
+}
+
+func TestApproveRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		approver  string
+		requestID string
+		quantity  int
+		wait      time.Duration
+		wantErr   string
+	}{
+		{name: "owner approves", approver: producerMSP, quantity: 2},
+		{name: "defaults to requested quantity", approver: producerMSP},
+		{name: "negative quantity", approver: producerMSP, quantity: -1, wantErr: "must be between 1 and 10"},
+		{name: "more than available", approver: producerMSP, quantity: 11, wantErr: "must be between 1 and 10"},
+		{name: "not the owner", approver: supplierMSP, quantity: 2, wantErr: "only the owner ProducerMSP may approve"},
+		{name: "unknown request", approver: producerMSP, requestID: "missing", quantity: 2, wantErr: "request missing for medicine Aspirin not found"},
+		{name: "expired request", approver: producerMSP, quantity: 2, wait: requestTTL, wantErr: "request expired at "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+
+			var request *MedicineRequest
+			err := fake.invoke(supplierMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				request, err = contract.RequestMedicine(ctx, "Aspirin", "restock", 3)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("RequestMedicine failed: %v", err)
+			}
+			requestID := request.ID
+			if tt.requestID != "" {
+				requestID = tt.requestID
+			}
+			fake.clock = fake.clock.Add(tt.wait)
+
+			var approved *MedicineRequest
+			err = fake.invoke(tt.approver, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				approved, err = contract.ApproveRequest(ctx, supplierMSP, "Aspirin", requestID, tt.quantity)
+				return err
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ApproveRequest error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if tt.wait > 0 && !strings.Contains(err.Error(), request.ExpiresAt.Format(time.RFC3339)) {
+					t.Errorf("ApproveRequest error = %v, want it to name the expiry %s", err, request.ExpiresAt.Format(time.RFC3339))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApproveRequest failed: %v", err)
+			}
+			wantQuantity := tt.quantity
+			if wantQuantity == 0 {
+				wantQuantity = request.Quantity
+			}
+			if approved.ID != request.ID || approved.Quantity != wantQuantity {
+				t.Errorf("approved request = %s for %d units, want %s for %d", approved.ID, approved.Quantity, request.ID, wantQuantity)
+			}
+			if fake.lastEvent == nil || fake.lastEvent.Name != "RequestApproved" {
+				t.Errorf("last event = %+v, want RequestApproved", fake.lastEvent)
+			}
+
+			// An approved request is no longer outstanding
+			var requests []*MedicineRequest
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				var err error
+				requests, err = contract.ListRequests(ctx)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("ListRequests failed: %v", err)
+			}
+			if len(requests) != 0 {
+				t.Errorf("ListRequests after approval = %d requests, want 0", len(requests))
+			}
+		})
+	}
+}
+
+func TestAdjustQuantityLowStockEvent(t *testing.T) {
+	tests := []struct {
+		name          string
+		minStockLevel int
+		earlierDelta  int
+		delta         int
+		wantQuantity  int
+		wantEvent     bool
+	}{
+		{name: "stays above the level", minStockLevel: 5, delta: -4},
+		{name: "reaches the level", minStockLevel: 5, delta: -5, wantQuantity: 5, wantEvent: true},
+		{name: "drops below the level", minStockLevel: 5, delta: -8, wantQuantity: 2, wantEvent: true},
+		{name: "already at the level", minStockLevel: 5, earlierDelta: -5, delta: -1},
+		{name: "restock", minStockLevel: 5, earlierDelta: -8, delta: 3},
+		{name: "no level set", delta: -10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeLedger(t)
+			contract := new(PharmaChaincode)
+			addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+			err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.SetMinStockLevel(ctx, "Aspirin", tt.minStockLevel)
+			})
+			if err != nil {
+				t.Fatalf("SetMinStockLevel failed: %v", err)
+			}
+			if tt.earlierDelta != 0 {
+				err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+					return contract.AdjustQuantity(ctx, "Aspirin", tt.earlierDelta)
+				})
+				if err != nil {
+					t.Fatalf("AdjustQuantity(%d) failed: %v", tt.earlierDelta, err)
+				}
+			}
+
+			fake.lastEvent = nil
+			err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+				return contract.AdjustQuantity(ctx, "Aspirin", tt.delta)
+			})
+			if err != nil {
+				t.Fatalf("AdjustQuantity(%d) failed: %v", tt.delta, err)
+			}
+
+			if !tt.wantEvent {
+				if fake.lastEvent != nil {
+					t.Errorf("AdjustQuantity emitted %s, want no event", fake.lastEvent.Name)
+				}
+				return
+			}
+			if fake.lastEvent == nil || fake.lastEvent.Name != "LowStock" {
+				t.Fatalf("last event = %+v, want LowStock", fake.lastEvent)
+			}
+			var payload lowStockEvent
+			err = json.Unmarshal(fake.lastEvent.Payload, &payload)
+			if err != nil {
+				t.Fatalf("failed to unmarshal LowStock payload: %v", err)
+			}
+			want := lowStockEvent{Name: "Aspirin", Owner: producerMSP, Quantity: tt.wantQuantity, MinStockLevel: tt.minStockLevel}
+			if payload != want {
+				t.Errorf("LowStock payload = %+v, want %+v", payload, want)
+			}
+		})
+	}
+}
+
+func TestLowStockEventCarriesOwnerContact(t *testing.T) {
+	fake := newFakeLedger(t)
+	contract := new(PharmaChaincode)
+	addTestMedicine(t, fake, producerMSP, "Aspirin", 10)
+	err := fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SetMinStockLevel(ctx, "Aspirin", 5)
+	})
+	if err != nil {
+		t.Fatalf("SetMinStockLevel failed: %v", err)
+	}
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.SetOwnerContact(ctx, "Aspirin", "pager:producer-stock")
+	})
+	if err != nil {
+		t.Fatalf("SetOwnerContact failed: %v", err)
+	}
+
+	err = fake.invoke(producerMSP, func(ctx contractapi.TransactionContextInterface) error {
+		return contract.AdjustQuantity(ctx, "Aspirin", -6)
+	})
+	if err != nil {
+		t.Fatalf("AdjustQuantity failed: %v", err)
+	}
+
+	if fake.lastEvent == nil || fake.lastEvent.Name != "LowStock" {
+		t.Fatalf("last event = %+v, want LowStock", fake.lastEvent)
+	}
+	var payload lowStockEvent
+	err = json.Unmarshal(fake.lastEvent.Payload, &payload)
+	if err != nil {
+		t.Fatalf("failed to unmarshal LowStock payload: %v", err)
+	}
+	if payload.OwnerContact != "pager:producer-stock" {
+		t.Errorf("LowStock owner contact = %q, want %q", payload.OwnerContact, "pager:producer-stock")
+	}
+}
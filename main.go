@@ -2,15 +2,15 @@ package main
 
 import (
 	"log"
-        "github.com/0xanony-nobody/KBA-Med/contracts/"
+
+	"github.com/0xanony-nobody/KBA-Med/contracts"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
 func main() {
 	medContract := new(contracts.PharmaChaincode)
-	
 
-	chaincode, err := contractapi.NewChaincode(PharmaChaincode)
+	chaincode, err := contractapi.NewChaincode(medContract)
 
 	if err != nil {
 		log.Panicf("Could not create chaincode." + err.Error())